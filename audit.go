@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Name audit records are logged under (the syslog tag, or the Windows event
+// source)
+const auditSource = "git-credential-azure-cli"
+
+// How long get waits for the audit log before giving up on the record
+const auditTimeout = 500 * time.Millisecond
+
+// auditGet writes a security audit record for a credential request to the
+// system log when azureCliCredentialHelper.auditSyslog is set: who the
+// token was for, never the token itself. err is nil when a credential was
+// issued. Auditing is best effort; it never fails or noticeably delays the
+// request. Replayed requests aren't audited.
+func auditGet(protocol, host string, err error) {
+	if replaying || !configBool(configKey("auditsyslog"), false) {
+		return
+	}
+	tenant := getTenantForHost(protocol, host)
+	if tenant == "" {
+		tenant = "default"
+	}
+	msg := fmt.Sprintf("get time=%s url=%s://%s scope=%s tenant=%s",
+		time.Now().UTC().Format(time.RFC3339), protocol, host, buildScope(getResourceForHost(protocol, host), ".default"), tenant)
+	if err != nil {
+		msg += fmt.Sprintf(" outcome=failed reason=%q", err.Error())
+	} else {
+		msg += " outcome=issued"
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- writeAuditRecord(msg, err == nil) }()
+	select {
+	case writeErr := <-done:
+		if writeErr != nil {
+			debugf(1, "Failed to write audit record: %v", writeErr)
+		}
+	case <-time.After(auditTimeout):
+		debugf(1, "Timed out writing audit record after %v", auditTimeout)
+	}
+}
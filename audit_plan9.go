@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// writeAuditRecord reports that Plan 9 has no system log to write to.
+func writeAuditRecord(msg string, issued bool) error {
+	return errors.New("auditSyslog is not supported on plan9")
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+
+package main
+
+import "log/syslog"
+
+// writeAuditRecord logs msg to the local syslog daemon under the auth
+// facility, as a notice for issued credentials and a warning otherwise.
+func writeAuditRecord(msg string, issued bool) error {
+	w, err := syslog.New(syslog.LOG_AUTH|syslog.LOG_NOTICE, auditSource)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if issued {
+		return w.Notice(msg)
+	}
+	return w.Warning(msg)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "golang.org/x/sys/windows/svc/eventlog"
+
+// Event IDs for audit records in the Windows Event Log
+const (
+	auditEventIssued = 1
+	auditEventFailed = 2
+)
+
+// writeAuditRecord logs msg to the Windows Event Log. Windows falls back to
+// the Application log if the event source isn't registered.
+func writeAuditRecord(msg string, issued bool) error {
+	l, err := eventlog.Open(auditSource)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if issued {
+		return l.Info(auditEventIssued, msg)
+	}
+	return l.Warning(auditEventFailed, msg)
+}
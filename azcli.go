@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// azCLITimeout bounds an az call when the caller's context has no deadline,
+// as azidentity does.
+const azCLITimeout = 10 * time.Second
+
+// azureCLICredential gets tokens from "az account get-access-token", as
+// azidentity.AzureCLICredential does, but runs az through azCommand. That
+// way az gets azEnvironment while the helper's own environment, which the
+// other credentials read, stays untouched; azidentity offers no way to give
+// az a separate environment.
+type azureCLICredential struct {
+	tenant       string
+	subscription string
+	// az isn't safe to run concurrently against one config directory
+	mu sync.Mutex
+}
+
+// newAzureCLICredential constructs an Azure CLI credential, passing tenant
+// and subscription to az when set.
+func newAzureCLICredential(tenant, subscription string) (azcore.TokenCredential, error) {
+	if tenant != "" && !validAzArg(tenant, ".-") {
+		return nil, fmt.Errorf("invalid tenant %q", tenant)
+	}
+	if subscription != "" && !validAzArg(subscription, ".-_ ") {
+		return nil, fmt.Errorf("subscription %q contains invalid characters; if this is the name of a subscription, use its ID instead", subscription)
+	}
+	return &azureCLICredential{tenant: tenant, subscription: subscription}, nil
+}
+
+// validAzArg reports whether s is only letters, digits and the given extra
+// characters.
+func validAzArg(s, extra string) bool {
+	for _, r := range s {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune(extra, r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// azArgs returns the az arguments that get a token for scope.
+func (c *azureCLICredential) azArgs(scope string) []string {
+	// az takes a v1 resource: older versions don't understand v2 scopes
+	args := []string{"account", "get-access-token", "-o", "json", "--resource", strings.TrimSuffix(scope, "/.default")}
+	if c.tenant != "" {
+		args = append(args, "--tenant", c.tenant)
+	}
+	if c.subscription != "" {
+		args = append(args, "--subscription", c.subscription)
+	}
+	return args
+}
+
+func (c *azureCLICredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if len(opts.Scopes) != 1 {
+		return azcore.AccessToken{}, errors.New("AzureCLICredential: GetToken() requires exactly one scope")
+	}
+	scope := opts.Scopes[0]
+	if !validAzArg(scope, ".-_/:") {
+		return azcore.AccessToken{}, fmt.Errorf("AzureCLICredential.GetToken(): invalid scope %q", scope)
+	}
+	if opts.Claims != "" {
+		login := "az login"
+		if c.tenant != "" {
+			login += " --tenant " + c.tenant
+		}
+		return azcore.AccessToken{}, fmt.Errorf("AzureCLICredential.GetToken(): Azure CLI requires multifactor authentication or additional claims. Run this command then retry the operation: %s --claims-challenge %s",
+			login, base64.StdEncoding.EncodeToString([]byte(opts.Claims)))
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, azCLITimeout)
+		defer cancel()
+	}
+	args := c.azArgs(scope)
+	debugf(3, "Running: az %s", strings.Join(args, " "))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cmd := azCommand(ctx, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = 100 * time.Millisecond
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrWaitDelay) && len(out) > 0 {
+		// az exited without closing stdout; what it wrote may be the token
+		err = nil
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		msg := strings.TrimSpace(stderr.String())
+		switch {
+		case errors.Is(err, exec.ErrNotFound), errors.As(err, &exitErr) && exitErr.ExitCode() == 127, strings.Contains(msg, "' is not recognized"):
+			return azcore.AccessToken{}, azidentity.NewCredentialUnavailableError("AzureCLICredential: Azure CLI executable not found on path")
+		case msg == "":
+			msg = err.Error()
+		}
+		return azcore.AccessToken{}, fmt.Errorf("AzureCLICredential: %s", msg)
+	}
+	return parseAzToken(out)
+}
+
+// parseAzToken parses az account get-access-token's JSON output. Older az
+// versions only report expiresOn, in local time.
+func parseAzToken(out []byte) (azcore.AccessToken, error) {
+	var t struct {
+		AccessToken string `json:"accessToken"`
+		ExpiresOnTS int64  `json:"expires_on"`
+		ExpiresOn   string `json:"expiresOn"`
+	}
+	if err := json.Unmarshal(out, &t); err != nil {
+		return azcore.AccessToken{}, fmt.Errorf("AzureCLICredential: failed to parse az output: %w", err)
+	}
+	expiry := time.Unix(t.ExpiresOnTS, 0)
+	if t.ExpiresOnTS == 0 {
+		var err error
+		expiry, err = time.ParseInLocation("2006-01-02 15:04:05.999999", t.ExpiresOn, time.Local)
+		if err != nil {
+			return azcore.AccessToken{}, fmt.Errorf("AzureCLICredential: error parsing token expiration time %q: %v", t.ExpiresOn, err)
+		}
+	}
+	return azcore.AccessToken{Token: t.AccessToken, ExpiresOn: expiry.UTC()}, nil
+}
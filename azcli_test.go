@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// writeFakeAz puts an az on PATH that prints a token whose value is the
+// arguments it got and whether REQUESTS_CA_BUNDLE reached it.
+func writeFakeAz(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake az is a shell script")
+	}
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "{\"accessToken\": \"$* bundle=${REQUESTS_CA_BUNDLE:-unset}\", \"expires_on\": 2000000000}"
+`
+	if err := os.WriteFile(filepath.Join(dir, "az"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestAzureCLICredential(t *testing.T) {
+	writeFakeAz(t)
+	t.Setenv("REQUESTS_CA_BUNDLE", "/etc/other-tool.pem")
+	setTestConfig(t, "azureclicredentialhelper.clearazenv", "true")
+
+	cred, err := newAzureCLICredential("contoso.onmicrosoft.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := cred.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{"499b84ac-1321-427f-aa17-267ca6975798/.default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "account get-access-token -o json --resource 499b84ac-1321-427f-aa17-267ca6975798 --tenant contoso.onmicrosoft.com bundle=unset"
+	if token.Token != want || token.ExpiresOn.Unix() != 2000000000 {
+		t.Errorf("GetToken() = %q, %v, want %q", token.Token, token.ExpiresOn, want)
+	}
+	if got := os.Getenv("REQUESTS_CA_BUNDLE"); got != "/etc/other-tool.pem" {
+		t.Errorf("REQUESTS_CA_BUNDLE in the helper's environment = %q, want it left alone", got)
+	}
+
+	if _, err := newAzureCLICredential("contoso; rm -rf", ""); err == nil {
+		t.Error("newAzureCLICredential accepted an invalid tenant")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Environment variables kept when azEnvIsolation is on: what az (and
+// Python under it) needs to run at all, proxy settings, and the variables
+// the helper itself reads later in a request.
+var baseAzEnvVars = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "LANG", "LC_ALL", "TZ",
+	"TMPDIR", "TEMP", "TMP",
+	"USERPROFILE", "APPDATA", "LOCALAPPDATA", "SYSTEMROOT", "SYSTEMDRIVE", "COMSPEC", "PATHEXT", "WINDIR",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	"GIT_TERMINAL_PROMPT", "SSH_CONNECTION", "SSH_TTY", "SSH_CLIENT",
+	"SSL_CERT_FILE", "SSL_CERT_DIR",
+	"ACTIONS_ID_TOKEN_REQUEST_URL", "ACTIONS_ID_TOKEN_REQUEST_TOKEN",
+}
+
+// Variables that commonly break az token acquisition when inherited, mostly
+// in CI: a stale config dir, a CA bundle meant for another tool, or Python
+// settings that hijack az's bundled interpreter. Cleared when
+// azureCliCredentialHelper.clearAzEnv is enabled; azureCliCredentialHelper.clearAzEnvVar
+// replaces the list.
+var defaultClearAzEnvVars = []string{
+	"AZURE_CONFIG_DIR",
+	"AZURE_EXTENSION_DIR",
+	"REQUESTS_CA_BUNDLE",
+	"CURL_CA_BUNDLE",
+	"PYTHONHOME",
+	"PYTHONPATH",
+}
+
+// azCommand returns a command running az with azEnvironment, for the az
+// invocations we make ourselves, leaving the process environment alone.
+func azCommand(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "az", args...)
+	cmd.Env, _ = azEnvironment()
+	return cmd
+}
+
+// azEnvironment returns the environment az should run with, and the names
+// of the variables it drops. With azureCliCredentialHelper.clearAzEnv it
+// drops variables known to interfere with az; with
+// azureCliCredentialHelper.azEnvIsolation it keeps only baseAzEnvVars, the
+// CI markers, AZURE_CLI_HELPER_* and anything listed in
+// azureCliCredentialHelper.azEnvPassthrough.
+func azEnvironment() ([]string, []string) {
+	clear := configBool(configKey("clearazenv"), false)
+	isolate := configBool(configKey("azenvisolation"), false)
+	passthrough := gitCfg.GetAll(configKey("azenvpassthrough"))
+	clearNames := gitCfg.GetAll(configKey("clearazenvvar"))
+	if len(clearNames) == 0 {
+		clearNames = defaultClearAzEnvVars
+	}
+	keep := slices.Concat(baseAzEnvVars, ciEnvVars, passthrough)
+
+	var env, cleared []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		switch {
+		case name == "" || containsEnvName(passthrough, name):
+		case clear && containsEnvName(clearNames, name),
+			isolate && !strings.HasPrefix(name, "AZURE_CLI_HELPER_") && !containsEnvName(keep, name):
+			cleared = append(cleared, name)
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env, cleared
+}
+
+// containsEnvName reports whether name is in names, ignoring case on
+// Windows where environment variable names are case-insensitive.
+func containsEnvName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name || (runtime.GOOS == "windows" && strings.EqualFold(n, name)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestInvocationPrefix(t *testing.T) {
+	allowed := []string{"azure-graph", " Azure-DevOps "}
+	tests := []struct {
+		arg0 string
+		want string
+	}{
+		{"git-credential-azure-cli", ""},
+		{"/usr/local/bin/git-credential-azure-cli", ""},
+		{"git-credential-azure-cli-linux-amd64", ""},
+		{"git-credential-azure-cli-windows-amd64.exe", ""},
+		{"/home/me/bin/git-credential-azure-graph", "azure-graph"},
+		{"git-credential-azure-devops.exe", "azure-devops"},
+		{"git-credential-Azure-Graph", "azure-graph"},
+		{"git-credential-azure-other", ""},
+		{"git-credential-", ""},
+		{"azure-graph", ""},
+	}
+	for _, tt := range tests {
+		if got := invocationPrefix(tt.arg0, allowed); got != tt.want {
+			t.Errorf("invocationPrefix(%q) = %q, want %q", tt.arg0, got, tt.want)
+		}
+	}
+	if got := invocationPrefix("git-credential-azure-graph", nil); got != "" {
+		t.Errorf("invocationPrefix without an allowlist = %q, want \"\"", got)
+	}
+}
+
+func TestConfigScopeArgs(t *testing.T) {
+	tests := []struct {
+		scope   string
+		want    []string
+		wantErr bool
+	}{
+		{"", []string{"--global"}, false},
+		{"global", []string{"--global"}, false},
+		{"system", []string{"--system"}, false},
+		{"file:/tmp/gitconfig", []string{"--file", "/tmp/gitconfig"}, false},
+		{"file:", nil, true},
+		{"globl", nil, true},
+		{"/tmp/gitconfig", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := configScopeArgs(tt.scope)
+		if (err != nil) != tt.wantErr || !slices.Equal(got, tt.want) {
+			t.Errorf("configScopeArgs(%q) = %v, %v, want %v (error %t)", tt.scope, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCustomConfigPrefix(t *testing.T) {
+	defer func(prefix string, fromEnv bool) {
+		configPrefix, configPrefixFromEnv = prefix, fromEnv
+	}(configPrefix, configPrefixFromEnv)
+	configPrefix, configPrefixFromEnv = "contoso", true
+
+	if got := configKey("tenantid"); got != "contoso.tenantid" {
+		t.Errorf("configKey = %q, want contoso.tenantid", got)
+	}
+	if got := configName("tenantID"); got != "contoso.tenantID" {
+		t.Errorf("configName = %q, want contoso.tenantID", got)
+	}
+
+	setTestConfig(t,
+		"contoso.https://dev.azure.com.tenant", "tenant-c",
+		"azureclicredentialhelper.https://dev.azure.com.resource", "https://ignored",
+	)
+	if got := getTenantForHost("https", "dev.azure.com"); got != "tenant-c" {
+		t.Errorf("tenant = %q, want the one under the custom prefix", got)
+	}
+	if got, ok := lookupResourceOverride("https", "dev.azure.com"); ok {
+		t.Errorf("override %q under the default section was used with a custom prefix", got)
+	}
+}
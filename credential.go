@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// Audience Entra ID expects on federated GitHub Actions OIDC tokens
+const githubActionsAudience = "api://AzureADTokenExchange"
+
+// Default timeout for each HTTP request we make directly, as opposed to
+// through az
+const defaultHTTPTimeout = 10 * time.Second
+
+// newHTTPClient returns the client for direct HTTP calls, with a per-request
+// timeout from azureCliCredentialHelper.httpTimeout. That's separate from the
+// overall acquisition timeout, so one slow endpoint can't use up the budget
+// for retries. It also applies the minTLSVersion and caBundle settings, and
+// identifies the helper in the User-Agent.
+func newHTTPClient() (*http.Client, error) {
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Timeout:   configDuration(configKey("httptimeout"), defaultHTTPTimeout),
+		Transport: &userAgentTransport{base: transport, userAgent: userAgent()},
+	}, nil
+}
+
+// userAgent returns the User-Agent for direct HTTP calls:
+// azureCliCredentialHelper.userAgent, or git-credential-azure-cli/<version>.
+func userAgent() string {
+	if ua := cleanConfigValue(gitCfg.Get(configKey("useragent"))); ua != "" && !strings.ContainsAny(ua, "\r\n") {
+		return ua
+	}
+	return "git-credential-azure-cli/" + version
+}
+
+// userAgentTransport puts the helper's User-Agent on every request, ahead
+// of the Azure SDK's own, so gateways and throttling policies can tell our
+// traffic apart while the SDK version stays visible.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ua := t.userAgent
+	if existing := req.Header.Get("User-Agent"); existing != "" {
+		ua += " " + existing
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", ua)
+	return t.base.RoundTrip(req)
+}
+
+// loadTLSConfig builds the TLS settings for direct HTTP calls. By default
+// that's TLS 1.2+ with the system trust store. azureCliCredentialHelper.caBundle
+// replaces the system roots with a PEM bundle, pinning the CAs trusted for
+// the endpoints we call.
+func loadTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch v := strings.TrimSpace(gitCfg.Get(configKey("mintlsversion"))); v {
+	case "", "1.2":
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported %s %q (use 1.2 or 1.3)", configName("minTLSVersion"), v)
+	}
+
+	if path := gitCfg.Get(configKey("cabundle")); path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read caBundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in caBundle %s", path)
+		}
+		cfg.RootCAs = pool
+		debugf(2, "Trusting only CAs from %s for direct HTTP", path)
+	}
+	return cfg, nil
+}
+
+// Credentials built so far in this process, keyed by tenant. One credential
+// serves every scope for its tenant, so bulk commands like stress don't
+// rebuild it per request and azidentity's token cache is shared.
+var (
+	credentialsMu sync.Mutex
+	credentials   = make(map[string]azcore.TokenCredential)
+)
+
+// getCredentialForTenant returns the process's credential for tenant,
+// constructing it on first use.
+func getCredentialForTenant(tenant string) (azcore.TokenCredential, error) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	if cred, ok := credentials[tenant]; ok {
+		debugf(3, "Reusing credential for tenant %q", tenant)
+		return cred, nil
+	}
+	cred, err := newCredential(tenant)
+	if err != nil {
+		return nil, err
+	}
+	credentials[tenant] = cred
+	return cred, nil
+}
+
+// newCredential constructs the credential used to acquire tokens. tenant
+// is the per-host tenant override, if any.
+//
+// An explicit azureCliCredentialHelper.credentialType always decides: azcli,
+// default (DefaultAzureCredential) or managedidentity, or a comma-separated
+// list of them to fall back through. Without one, GitHub Actions workload
+// identity is used when a client ID is configured and the job has an OIDC
+// token, then a configured certificatePath, then the Azure CLI login.
+func newCredential(tenant string) (azcore.TokenCredential, error) {
+	var credTypes []string
+	for _, t := range strings.Split(gitCfg.Get(configKey("credentialtype")), ",") {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			credTypes = append(credTypes, t)
+		}
+	}
+
+	switch {
+	case len(credTypes) == 1:
+		return newCredentialOfType(credTypes[0], tenant)
+	case len(credTypes) > 1:
+		return newChainedCredential(credTypes, tenant)
+	}
+
+	if clientID := gitCfg.Get(configKey("clientid")); clientID != "" && isGitHubActionsOIDCAvailable() {
+		if tenant == "" {
+			tenant = gitCfg.Get(configKey("tenantid"))
+		}
+		if tenant == "" {
+			return nil, fmt.Errorf("%s is required for GitHub Actions workload identity", configName("tenantID"))
+		}
+		debugf(1, "Using GitHub Actions workload identity federation for client ID %s", clientID)
+		client, err := newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		return azidentity.NewClientAssertionCredential(tenant, clientID, getGitHubActionsOIDCToken, &azidentity.ClientAssertionCredentialOptions{
+			ClientOptions: azcore.ClientOptions{Transport: client},
+		})
+	}
+
+	if certPath := gitCfg.Get(configKey("certificatepath")); certPath != "" {
+		return newCertificateCredential(tenant, certPath)
+	}
+
+	return newCredentialOfType("azcli", tenant)
+}
+
+// newCredentialOfType constructs the credential for one
+// azureCliCredentialHelper.credentialType value.
+func newCredentialOfType(credType, tenant string) (azcore.TokenCredential, error) {
+	switch credType {
+	case "azcli":
+		return newAzureCLICredential(tenant, gitCfg.Get(configKey("subscription")))
+	case "default":
+		debugf(1, "Using DefaultAzureCredential")
+		client, err := newHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		return azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: azcore.ClientOptions{Transport: client},
+			TenantID:      tenant,
+		})
+	case "managedidentity":
+		return newManagedIdentityCredential(tenant)
+	default:
+		return nil, fmt.Errorf("unknown %s %q (use azcli, default or managedidentity)", configName("credentialType"), credType)
+	}
+}
+
+// chainedCredential tries each of its credentials in turn until one returns
+// a token. Unlike azidentity's ChainedTokenCredential it moves on after any
+// failure, since the Azure CLI credential reports a missing login as an
+// ordinary error rather than as unavailable.
+type chainedCredential struct {
+	names []string
+	creds []azcore.TokenCredential
+}
+
+// newChainedCredential constructs a chainedCredential trying credTypes in
+// order.
+func newChainedCredential(credTypes []string, tenant string) (azcore.TokenCredential, error) {
+	chain := &chainedCredential{names: credTypes, creds: make([]azcore.TokenCredential, len(credTypes))}
+	for i, credType := range credTypes {
+		cred, err := newCredentialOfType(credType, tenant)
+		if err != nil {
+			return nil, err
+		}
+		chain.creds[i] = cred
+	}
+	debugf(1, "Using credential chain: %s", strings.Join(credTypes, ", "))
+	return chain, nil
+}
+
+func (c *chainedCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	var errs []error
+	for i, cred := range c.creds {
+		token, err := cred.GetToken(ctx, opts)
+		if err == nil {
+			debugf(2, "Token acquired with the %s credential", c.names[i])
+			return token, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", c.names[i], err))
+		if ctx.Err() != nil {
+			break
+		}
+		if i+1 < len(c.creds) {
+			debugf(1, "The %s credential failed, trying %s: %v", c.names[i], c.names[i+1], err)
+		}
+	}
+	return azcore.AccessToken{}, errors.Join(errs...)
+}
+
+// newManagedIdentityCredential constructs a managed identity credential,
+// for the user-assigned identity named by managedIdentityClientID if any. A
+// managed identity belongs to one tenant, so tenant overrides can't apply.
+func newManagedIdentityCredential(tenant string) (azcore.TokenCredential, error) {
+	if tenant != "" {
+		debugf(1, "Ignoring tenant %s: managed identity tokens always come from the identity's own tenant", tenant)
+	}
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	opts := &azidentity.ManagedIdentityCredentialOptions{
+		ClientOptions: azcore.ClientOptions{Transport: client},
+	}
+	if clientID := managedIdentityClientID(); clientID != "" {
+		debugf(1, "Using managed identity with client ID %s", clientID)
+		opts.ID = azidentity.ClientID(clientID)
+	} else {
+		debugf(1, "Using system-assigned managed identity")
+	}
+	return azidentity.NewManagedIdentityCredential(opts)
+}
+
+// managedIdentityClientID returns the client ID of the user-assigned managed
+// identity to use, or "" for the system-assigned one:
+// azureCliCredentialHelper.managedIdentityClientID, else clientID (which
+// also names the app for workload identity and certificates).
+func managedIdentityClientID() string {
+	if clientID := gitCfg.Get(configKey("managedidentityclientid")); clientID != "" {
+		return clientID
+	}
+	return gitCfg.Get(configKey("clientid"))
+}
+
+// newCertificateCredential constructs a service principal credential from
+// the PEM or PKCS#12 certificate at certPath, for environments that require
+// certificate auth. The password comes from
+// azureCliCredentialHelper.certificatePassword or
+// AZURE_CLIENT_CERTIFICATE_PASSWORD. Expired or not-yet-valid certificates
+// are rejected here rather than as an opaque AADSTS error.
+func newCertificateCredential(tenant, certPath string) (azcore.TokenCredential, error) {
+	clientID := gitCfg.Get(configKey("clientid"))
+	if clientID == "" {
+		return nil, fmt.Errorf("%s is required with certificatePath", configName("clientID"))
+	}
+	if tenant == "" {
+		tenant = gitCfg.Get(configKey("tenantid"))
+	}
+	if tenant == "" {
+		return nil, fmt.Errorf("%s is required with certificatePath", configName("tenantID"))
+	}
+
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	password := gitCfg.Get(configKey("certificatepassword"))
+	if password == "" {
+		password = os.Getenv("AZURE_CLIENT_CERTIFICATE_PASSWORD")
+	}
+	var passwordBytes []byte
+	if password != "" {
+		passwordBytes = []byte(password)
+	}
+	certs, key, err := azidentity.ParseCertificates(data, passwordBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %s (PEM or PKCS#12 with a private key is required): %w", certPath, err)
+	}
+	now := time.Now()
+	for _, cert := range certs {
+		if now.After(cert.NotAfter) {
+			return nil, fmt.Errorf("certificate %s expired on %s", certPath, cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		if now.Before(cert.NotBefore) {
+			return nil, fmt.Errorf("certificate %s is not valid until %s", certPath, cert.NotBefore.UTC().Format(time.RFC3339))
+		}
+	}
+
+	debugf(1, "Using certificate credential for client ID %s", clientID)
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	return azidentity.NewClientCertificateCredential(tenant, clientID, certs, key, &azidentity.ClientCertificateCredentialOptions{
+		ClientOptions: azcore.ClientOptions{Transport: client},
+	})
+}
+
+// isGitHubActionsOIDCAvailable reports whether we're in a GitHub Actions job
+// that was granted the id-token permission.
+func isGitHubActionsOIDCAvailable() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true" &&
+		os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL") != "" &&
+		os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN") != ""
+}
+
+// getGitHubActionsOIDCToken fetches the job's OIDC token from the Actions
+// runtime, for exchange with Entra ID as a client assertion.
+func getGitHubActionsOIDCToken(ctx context.Context) (string, error) {
+	requestURL, err := url.Parse(os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL"))
+	if err != nil {
+		return "", fmt.Errorf("invalid ACTIONS_ID_TOKEN_REQUEST_URL: %w", err)
+	}
+	query := requestURL.Query()
+	query.Set("audience", githubActionsAudience)
+	requestURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN"))
+	req.Header.Set("Accept", "application/json")
+
+	debugf(2, "Requesting GitHub Actions OIDC token")
+	client, err := newHTTPClient()
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request GitHub Actions OIDC token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub Actions OIDC token request failed: %s", resp.Status)
+	}
+
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode GitHub Actions OIDC token response: %w", err)
+	}
+	if body.Value == "" {
+		return "", errors.New("GitHub Actions OIDC token response was empty")
+	}
+	return body.Value, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key as PEM.
+func writeTestCertificate(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewCredential(t *testing.T) {
+	certPath := writeTestCertificate(t)
+	oidc := []string{"azureclicredentialhelper.clientid", "00000000-0000-0000-0000-000000000001", "azureclicredentialhelper.tenantid", "contoso.onmicrosoft.com"}
+	tests := []struct {
+		name    string
+		config  []string
+		actions bool
+		want    string
+	}{
+		{"Azure CLI by default", nil, false, "*main.azureCLICredential"},
+		{"azcli", []string{"azureclicredentialhelper.credentialtype", "azcli"}, false, "*main.azureCLICredential"},
+		{"default", []string{"azureclicredentialhelper.credentialtype", " Default "}, false, "*azidentity.DefaultAzureCredential"},
+		{"managed identity", []string{"azureclicredentialhelper.credentialtype", "managedidentity"}, false, "*azidentity.ManagedIdentityCredential"},
+		{"fallback chain", []string{"azureclicredentialhelper.credentialtype", "azcli, default"}, false, "*main.chainedCredential"},
+		{"unknown type", []string{"azureclicredentialhelper.credentialtype", "bogus"}, false, "error"},
+		{"unknown type in chain", []string{"azureclicredentialhelper.credentialtype", "azcli,bogus"}, false, "error"},
+		{"GitHub Actions", oidc, true, "*azidentity.ClientAssertionCredential"},
+		{"client ID outside Actions", oidc, false, "*main.azureCLICredential"},
+		{"GitHub Actions without tenant", oidc[:2], true, "error"},
+		{"certificate", append([]string{"azureclicredentialhelper.certificatepath", certPath}, oidc...), false, "*azidentity.ClientCertificateCredential"},
+		{"GitHub Actions before certificate", append([]string{"azureclicredentialhelper.certificatepath", certPath}, oidc...), true, "*azidentity.ClientAssertionCredential"},
+		{"credentialType wins over GitHub Actions", append([]string{"azureclicredentialhelper.credentialtype", "azcli"}, oidc...), true, "*main.azureCLICredential"},
+		{"credentialType wins over certificate", append([]string{"azureclicredentialhelper.credentialtype", "default", "azureclicredentialhelper.certificatepath", certPath}, oidc...), false, "*azidentity.DefaultAzureCredential"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GITHUB_ACTIONS", "")
+			t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", "")
+			t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "")
+			if tt.actions {
+				t.Setenv("GITHUB_ACTIONS", "true")
+				t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", "https://token.actions.example.com/")
+				t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "request-token")
+			}
+			setTestConfig(t, tt.config...)
+			cred, err := newCredential("")
+			got := fmt.Sprintf("%T", cred)
+			if err != nil {
+				got = "error"
+			}
+			if got != tt.want {
+				t.Errorf("newCredential() = %s (err %v), want %s", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagedIdentityClientID(t *testing.T) {
+	tests := []struct {
+		name   string
+		config []string
+		want   string
+	}{
+		{"system-assigned", nil, ""},
+		{"clientID", []string{"azureclicredentialhelper.clientid", "app"}, "app"},
+		{"managedIdentityClientID", []string{"azureclicredentialhelper.managedidentityclientid", "identity"}, "identity"},
+		{"managedIdentityClientID wins", []string{"azureclicredentialhelper.clientid", "app", "azureclicredentialhelper.managedidentityclientid", "identity"}, "identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, tt.config...)
+			if got := managedIdentityClientID(); got != tt.want {
+				t.Errorf("managedIdentityClientID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChainedCredential(t *testing.T) {
+	errNoLogin := errors.New("Please run 'az login' to setup account.")
+	tests := []struct {
+		name      string
+		creds     []*stubCredential
+		wantToken bool
+		wantCalls []int
+	}{
+		{"first succeeds", []*stubCredential{{}, {}}, true, []int{1, 0}},
+		{"falls back after a failure", []*stubCredential{{errs: []error{errNoLogin}}, {}}, true, []int{1, 1}},
+		{"all fail", []*stubCredential{{errs: []error{errNoLogin}}, {errs: []error{errNoLogin}}}, false, []int{1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := &chainedCredential{names: []string{"azcli", "default"}}
+			for _, c := range tt.creds {
+				chain.creds = append(chain.creds, c)
+			}
+			token, err := chain.GetToken(context.Background(), policy.TokenRequestOptions{Scopes: []string{"https://example.com/.default"}})
+			if (err == nil) != tt.wantToken {
+				t.Fatalf("err = %v, want token %t", err, tt.wantToken)
+			}
+			if tt.wantToken && token.Token != "token" {
+				t.Errorf("token = %q", token.Token)
+			}
+			for i, c := range tt.creds {
+				if c.calls != tt.wantCalls[i] {
+					t.Errorf("credential %d called %d times, want %d", i, c.calls, tt.wantCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUserAgentTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   []string
+		existing string
+		want     string
+	}{
+		{"default", nil, "", "git-credential-azure-cli/" + version},
+		{"ahead of the SDK's", nil, "azsdk-go-azidentity/v1.13.1 (go1.24; linux)", "git-credential-azure-cli/" + version + " azsdk-go-azidentity/v1.13.1 (go1.24; linux)"},
+		{"configured", []string{"azureclicredentialhelper.useragent", " contoso-ci/1.0 "}, "", "contoso-ci/1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, tt.config...)
+			var got string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("User-Agent")
+			}))
+			defer server.Close()
+			client, err := newHTTPClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing != "" {
+				req.Header.Set("User-Agent", tt.existing)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got != tt.want {
+				t.Errorf("User-Agent = %q, want %q", got, tt.want)
+			}
+			if req.Header.Get("User-Agent") != tt.existing {
+				t.Error("the caller's request was modified")
+			}
+		})
+	}
+}
+
+func TestHTTPTimeout(t *testing.T) {
+	setTestConfig(t, "azureclicredentialhelper.httptimeout", "200ms")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", server.URL)
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "request-token")
+
+	start := time.Now()
+	_, err := getGitHubActionsOIDCToken(context.Background())
+	if err == nil {
+		t.Fatal("request to a hung server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v, want it cut off after httpTimeout", elapsed)
+	}
+}
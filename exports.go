@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Shell syntax for the exports command (bash, zsh, fish, powershell, cmd)
+var exportsShell string
+
+// GOAUTH overrides for the exports command: a verbatim value, or the
+// directory for the default "git <dir>" form
+var (
+	goauthCmd string
+	goauthDir string
+)
+
+// goauthValue returns the GOAUTH value to export. By default that's
+// "git <dir>", which has Go run "git credential fill" in the helper's
+// directory; --goauth-dir picks another directory (which must exist) and
+// --goauth-cmd replaces the whole value, e.g. to chain several schemes.
+func goauthValue(exePath string) (string, error) {
+	if goauthCmd != "" {
+		return goauthCmd, nil
+	}
+	dir := goauthDir
+	if dir == "" {
+		dir = filepath.Dir(exePath)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("GOAUTH directory %s does not exist", dir)
+	}
+	return "git " + dir, nil
+}
+
+// goauthWarnings lists configured output settings that would break Go's
+// GOAUTH "git" mode. Go runs "git credential fill" with only url= on stdin,
+// reads stdout and stderr combined, and only understands protocol, host,
+// path, url, username and password, sending the password as Basic auth. It
+// ignores authtype and password_expiry_utc, so those are harmless, but a
+// renamed or missing password field leaves it with no credential at all.
+func goauthWarnings() []string {
+	var warnings []string
+	if passwordField != "password" {
+		warnings = append(warnings, fmt.Sprintf("passwordField is %q, but Go only reads password=", passwordField))
+	}
+	if !slices.Contains(outputFields, "password") {
+		warnings = append(warnings, "outputFields doesn't include password, so Go will get no credential")
+	}
+	return warnings
+}
+
+// Shells the exports command can format for
+var exportShells = []string{"bash", "zsh", "sh", "fish", "powershell", "pwsh", "cmd"}
+
+// detectShell guesses the user's shell from $SHELL, defaulting to
+// PowerShell on Windows and bash elsewhere.
+func detectShell() string {
+	if shell := os.Getenv("SHELL"); shell != "" {
+		name := strings.TrimSuffix(filepath.Base(shell), ".exe")
+		for _, s := range exportShells {
+			if name == s {
+				return s
+			}
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return "powershell"
+	}
+	return "bash"
+}
+
+// formatExport renders one environment variable assignment in the given
+// shell's syntax, quoting value so it survives unchanged.
+func formatExport(shell, name, value string) (string, error) {
+	switch shell {
+	case "bash", "zsh", "sh":
+		r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+		return fmt.Sprintf("export %s=\"%s\"", name, r.Replace(value)), nil
+	case "fish":
+		r := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+		return fmt.Sprintf("set -gx %s '%s'", name, r.Replace(value)), nil
+	case "powershell", "pwsh":
+		return fmt.Sprintf("$env:%s = '%s'", name, strings.ReplaceAll(value, "'", "''")), nil
+	case "cmd":
+		// cmd has no general escaping; the quotes around the whole
+		// assignment keep spaces and most metacharacters intact
+		return fmt.Sprintf("set \"%s=%s\"", name, strings.ReplaceAll(value, "%", "%%")), nil
+	default:
+		return "", fmt.Errorf("unsupported shell %q (use %s)", shell, strings.Join(exportShells, ", "))
+	}
+}
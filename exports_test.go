@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestFormatExport(t *testing.T) {
+	const value = `a\b "c" $d 'e' %f% ` + "`g`"
+	tests := []struct {
+		shell string
+		want  string
+	}{
+		{"bash", `export V="a\\b \"c\" \$d 'e' %f% ` + "\\`g\\`" + `"`},
+		{"zsh", `export V="a\\b \"c\" \$d 'e' %f% ` + "\\`g\\`" + `"`},
+		{"sh", `export V="a\\b \"c\" \$d 'e' %f% ` + "\\`g\\`" + `"`},
+		{"fish", `set -gx V 'a\\b "c" $d \'e\' %f% ` + "`g`'"},
+		{"powershell", `$env:V = 'a\b "c" $d ''e'' %f% ` + "`g`'"},
+		{"pwsh", `$env:V = 'a\b "c" $d ''e'' %f% ` + "`g`'"},
+		{"cmd", `set "V=a\b "c" $d 'e' %%f%% ` + "`g`\""},
+	}
+	for _, tt := range tests {
+		got, err := formatExport(tt.shell, "V", value)
+		if err != nil {
+			t.Errorf("formatExport(%s): %v", tt.shell, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("formatExport(%s) = %s, want %s", tt.shell, got, tt.want)
+		}
+	}
+	if _, err := formatExport("tcsh", "V", value); err == nil {
+		t.Error("formatExport accepted an unsupported shell")
+	}
+}
+
+func TestFormatExportShRoundTrip(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	const value = `a\b "c" $d 'e' %f% ` + "`g`"
+	line, err := formatExport("sh", "V", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(sh, "-c", line+`; printf %s "$V"`).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != value {
+		t.Errorf("sh evaluated %s to %q, want %q", line, out, value)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var verifyIntegrityOnce sync.Once
+
+// verifyIntegrity checks the running executable against
+// azureCliCredentialHelper.expectedSHA256, if set, and exits if it doesn't
+// match. The value is only honored from system config, which ordinary users
+// (and cloned repositories) can't write, and always from the standard
+// section, so an invocation name switching sections can't skip the check.
+// It runs at most once per process, and hashes nothing unless enabled.
+//
+// The expected hash has to live outside the binary: a hash embedded at
+// build time (say with -ldflags) would change the binary it describes.
+func verifyIntegrity() {
+	verifyIntegrityOnce.Do(checkIntegrity)
+}
+
+func checkIntegrity() {
+	if err := integrityError(); err != nil {
+		fmt.Fprintf(os.Stderr, "git-credential-azure-cli: integrity check failed, refusing to run: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// integrityError returns why the running executable fails the integrity
+// check, or nil if it passes or no check is configured.
+func integrityError() error {
+	key := standardConfigPrefix + ".expectedsha256"
+	if !gitCfg.IsSet(key) {
+		return nil
+	}
+	out, err := exec.Command("git", "config", "--system", "--get", key).Output()
+	if err != nil {
+		debugf(1, "Ignoring %s.expectedSHA256: only honored in system config", standardConfigPrefix)
+		return nil
+	}
+	expected := strings.TrimSpace(string(out))
+	if expected == "" {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	actual, err := fileSHA256(exe)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%s has SHA-256 %s, expected %s", exe, actual, expected)
+	}
+	debugf(2, "Executable hash matches expected value from system config")
+	return nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIntegrityError(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := fileSHA256(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		system   string
+		config   string
+		wantFail bool
+	}{
+		{"unset", "", "", false},
+		{"match", actual, actual, false},
+		{"match ignoring case", strings.ToUpper(actual), actual, false},
+		{"mismatch", strings.Repeat("0", 64), actual, true},
+		{"only honored in system config", "", strings.Repeat("0", 64), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config == "" {
+				setTestConfig(t)
+			} else {
+				setTestConfig(t, "azureclicredentialhelper.expectedsha256", tt.config)
+			}
+			system := filepath.Join(t.TempDir(), "gitconfig")
+			content := ""
+			if tt.system != "" {
+				content = "[azureCliCredentialHelper]\n\texpectedSHA256 = " + tt.system + "\n"
+			}
+			if err := os.WriteFile(system, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("GIT_CONFIG_SYSTEM", system)
+			if err := integrityError(); (err != nil) != tt.wantFail {
+				t.Errorf("integrityError() = %v, want failure %t", err, tt.wantFail)
+			}
+		})
+	}
+}
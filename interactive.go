@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// Whether the helper may run "az login" when the Azure CLI session has expired
+var interactive bool
+
+// Environment variables set by common CI systems. We never prompt there.
+var ciEnvVars = []string{"CI", "TF_BUILD", "GITHUB_ACTIONS", "BUILD_BUILDID", "JENKINS_URL", "GITLAB_CI"}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// canPromptUser reports whether it's reasonable to start an interactive
+// login: a user is at a terminal, git hasn't disabled prompting, and we're
+// not in CI. stdin carries the credential protocol, so stderr is what tells
+// us whether a human is watching.
+func canPromptUser() bool {
+	if os.Getenv("GIT_TERMINAL_PROMPT") == "0" {
+		return false
+	}
+	for _, v := range ciEnvVars {
+		if os.Getenv(v) != "" {
+			return false
+		}
+	}
+	return isTerminal(os.Stderr)
+}
+
+// isSSHSession reports whether we're running over SSH, where az login can't
+// open a local browser and device code flow is needed instead.
+func isSSHSession() bool {
+	return os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" || os.Getenv("SSH_CLIENT") != ""
+}
+
+// claimsChallengeError reports a claims challenge (for example, for MFA)
+// that the Azure CLI credential can't pass to az: only a new az login with
+// the challenge satisfies it.
+type claimsChallengeError struct {
+	tenant string
+	claims string
+}
+
+func (e *claimsChallengeError) Error() string {
+	return "the server sent a claims challenge, which the Azure CLI can only satisfy by signing in again with it"
+}
+
+// loginArgs returns the az arguments that satisfy the challenge.
+func (e *claimsChallengeError) loginArgs() []string {
+	args := []string{"login"}
+	if e.tenant != "" {
+		args = append(args, "--tenant", e.tenant)
+	}
+	return append(args, "--claims-challenge", base64.StdEncoding.EncodeToString([]byte(e.claims)))
+}
+
+// isLoginRequired reports whether err means the Azure CLI session is missing
+// or expired, as opposed to some other failure that logging in won't fix.
+// Claims challenges are excluded: a plain az login doesn't satisfy them.
+func isLoginRequired(err error) bool {
+	var claimsErr *claimsChallengeError
+	if errors.As(err, &claimsErr) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "--claims-challenge") {
+		return false
+	}
+	for _, pattern := range []string{
+		"az login",
+		"aadsts700082", // refresh token expired due to inactivity
+		"aadsts70043",  // refresh token expired due to sign-in frequency
+		"aadsts50173",  // grant expired because credentials changed
+		"interaction_required",
+	} {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// runAzLogin runs "az login" for the user, using device code flow over SSH,
+// and passing claims (as JSON) with --claims-challenge if there are any.
+// az's output goes to stderr so it can't corrupt the credential protocol on
+// stdout.
+func runAzLogin(tenant, claims string) error {
+	args := []string{"login"}
+	if isSSHSession() {
+		args = append(args, "--use-device-code")
+	}
+	if tenant != "" {
+		args = append(args, "--tenant", tenant)
+	}
+	if claims != "" {
+		args = append(args, "--claims-challenge", base64.StdEncoding.EncodeToString([]byte(claims)))
+	}
+
+	cmd := azCommand(context.Background(), args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	// Our stdin is the credential request, so give az the terminal instead
+	// in case it wants to prompt (e.g. for subscription selection).
+	ttyPath := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		ttyPath = "CONIN$"
+	}
+	if tty, err := os.Open(ttyPath); err == nil {
+		defer tty.Close()
+		cmd.Stdin = tty
+	}
+
+	debugf(1, "Running: az %s", strings.Join(args, " "))
+	return cmd.Run()
+}
+
+// loginGuidance translates a failed token acquisition into an actionable
+// next step for the environment we're running in, for the human-facing
+// subcommands. It returns "" if the failure isn't something logging in (or
+// installing az) would fix.
+func loginGuidance(err error) string {
+	var claimsErr *claimsChallengeError
+	if errors.As(err, &claimsErr) {
+		return "Run 'az " + strings.Join(claimsErr.loginArgs(), " ") + "' to satisfy the server's claims challenge, then retry (or pass --interactive to have the helper run it)."
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "executable not found") || strings.Contains(msg, "az: not found") {
+		return "Install the Azure CLI (https://aka.ms/installazurecli) and run 'az login'."
+	}
+	if !isLoginRequired(err) && !strings.Contains(msg, "not logged in") {
+		return ""
+	}
+	switch {
+	case os.Getenv("IDENTITY_ENDPOINT") != "" || os.Getenv("MSI_ENDPOINT") != "":
+		return "Run 'az login --identity', and make sure a managed identity is assigned to this resource."
+	case slices.ContainsFunc(ciEnvVars, func(v string) bool { return os.Getenv(v) != "" }):
+		if os.Getenv("GITHUB_ACTIONS") == "true" {
+			return "In GitHub Actions, set " + configName("clientID") + " and tenantID to use workload identity, or run azure/login before git."
+		}
+		return "In CI, log in before running git, e.g. 'az login --service-principal' or 'az login --federated-token'."
+	case isSSHSession():
+		return "Run 'az login --use-device-code'."
+	default:
+		return "Run 'az login'."
+	}
+}
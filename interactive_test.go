@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClaimsChallengeNeedsClaimsLogin(t *testing.T) {
+	setTestConfig(t)
+	cred, err := newAzureCLICredential("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestCredential(t, "", cred)
+	interactive = false
+	// {"access_token":{"acrs":{"essential":true,"value":"c1"}}}
+	wwwauth := []string{`Bearer authorization_uri="https://login.microsoftonline.com/common/oauth2/authorize", error="insufficient_claims", claims="eyJhY2Nlc3NfdG9rZW4iOnsiYWNycyI6eyJlc3NlbnRpYWwiOnRydWUsInZhbHVlIjoiYzEifX19"`}
+
+	_, _, err = acquireToken(context.Background(), "https", "dev.azure.com", wwwauth, nil)
+	var claimsErr *claimsChallengeError
+	if !errors.As(err, &claimsErr) {
+		t.Fatalf("acquireToken error = %v, want a claims challenge error", err)
+	}
+	if isLoginRequired(err) {
+		t.Error("isLoginRequired matched a claims challenge, but a plain az login won't satisfy it")
+	}
+	guidance := loginGuidance(err)
+	if !strings.Contains(guidance, "az login --claims-challenge eyJhY2Nlc3NfdG9rZW4iOnsiYWNycyI6eyJlc3NlbnRpYWwiOnRydWUsInZhbHVlIjoiYzEifX19") {
+		t.Errorf("loginGuidance = %q, want the az login --claims-challenge command", guidance)
+	}
+}
+
+func TestIsLoginRequired(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("ERROR: Please run 'az login' to setup account."), true},
+		{errors.New("AADSTS700082: The refresh token has expired due to inactivity."), true},
+		{errors.New("AzureCLICredential.GetToken(): Azure CLI requires multifactor authentication or additional claims. Run this command then retry the operation: az login --claims-challenge eyJ9"), false},
+		{&claimsChallengeError{claims: "{}"}, false},
+		{errors.New("AADSTS500011: The resource principal was not found"), false},
+	}
+	for _, tt := range tests {
+		if got := isLoginRequired(tt.err); got != tt.want {
+			t.Errorf("isLoginRequired(%q) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
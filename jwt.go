@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Skew beyond which we warn that the local clock looks wrong
+const clockSkewThreshold = 5 * time.Minute
+
+// decodeJWTClaims decodes the payload of a JWT without verifying it. We only
+// use this for advisory checks on tokens we just received from Entra ID.
+// Returns an error for opaque (non-JWT) tokens.
+func decodeJWTClaims(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// claimTime reads a NumericDate claim such as iat or exp.
+func claimTime(claims map[string]any, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// checkClockSkew warns when the token's timestamps suggest the local clock
+// is off, a common cause of tokens git rejects or discards early. The Azure
+// CLI hands out cached tokens, so an old iat is normal; only a token issued
+// in the future or already expired by our clock is suspicious. Advisory
+// only.
+func checkClockSkew(token string) {
+	claims, err := decodeJWTClaims(token)
+	if err != nil {
+		debugf(3, "Skipping clock skew check: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, name := range []string{"iat", "nbf"} {
+		if t, ok := claimTime(claims, name); ok && t.Sub(now) > clockSkewThreshold {
+			debugf(1, "WARNING: token %s is %v in the future; the local clock appears to be behind", name, t.Sub(now).Round(time.Second))
+			return
+		}
+	}
+	if t, ok := claimTime(claims, "exp"); ok && now.Sub(t) > clockSkewThreshold {
+		debugf(1, "WARNING: token expired %v ago by the local clock; the local clock appears to be ahead", now.Sub(t).Round(time.Second))
+	}
+}
+
+// checkLoginHint verifies that a token was issued to the account named by
+// the host's loginHint (a UPN). The Azure CLI picks the account itself, so
+// when it's logged in to several this is how we notice it chose the wrong
+// one. Opaque tokens can't be checked and pass.
+func checkLoginHint(token, loginHint string) error {
+	claims, err := decodeJWTClaims(token)
+	if err != nil {
+		debugf(3, "Skipping loginHint check: %v", err)
+		return nil
+	}
+	var account string
+	for _, name := range []string{"upn", "preferred_username", "unique_name", "email"} {
+		if v, ok := claims[name].(string); ok && v != "" {
+			account = v
+			if strings.EqualFold(v, loginHint) {
+				return nil
+			}
+		}
+	}
+	if account == "" {
+		debugf(2, "Token has no account claim to compare with loginHint")
+		return nil
+	}
+	return fmt.Errorf("token was issued to %s, not loginHint %s; select the right account with 'az login' or a .tenant override", account, loginHint)
+}
+
+// Tenant ID that personal Microsoft accounts (MSA) are issued tokens from
+const personalAccountTenant = "9188040d-6c67-4c5b-b112-36a304b66dad"
+
+// checkWorkAccount rejects tokens issued to a personal Microsoft account,
+// for azureCliCredentialHelper.requireWorkAccount. Opaque tokens can't be
+// checked and pass.
+func checkWorkAccount(token string) error {
+	claims, err := decodeJWTClaims(token)
+	if err != nil {
+		debugf(3, "Skipping requireWorkAccount check: %v", err)
+		return nil
+	}
+	if tid, _ := claims["tid"].(string); strings.EqualFold(tid, personalAccountTenant) {
+		return errors.New("token was issued to a personal Microsoft account and requireWorkAccount is set; log in with a work or school account")
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Where debugf writes. stderr by default; --log-file or logFile can send it
+// to a file or an inherited descriptor instead, keeping diagnostics apart
+// from whatever else the embedder reads from stderr.
+var logOutput io.Writer = os.Stderr
+
+// Value of --log-file, if given
+var logFile string
+
+// When logging elsewhere, messages at or below this level are also copied
+// to stderr (azureCliCredentialHelper.logStderrLevel). -1 copies nothing.
+var logStderrLevel = -1
+
+// openLogOutput points debugf at dest: "stderr" (or ""), "fd:N" for a
+// descriptor inherited from the parent, or a file path to append to. Stdout
+// carries the credential, so any dest that resolves to it is refused. A
+// file opened for an earlier dest is closed once the new one is in place.
+func openLogOutput(dest string) error {
+	var f *os.File
+	opened := false
+	switch {
+	case dest == "" || dest == "stderr":
+		setLogOutput(os.Stderr)
+		return nil
+	case strings.HasPrefix(dest, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(dest, "fd:"))
+		if err != nil || fd < 0 {
+			return fmt.Errorf("invalid log descriptor %q", dest)
+		}
+		f = os.NewFile(uintptr(fd), dest)
+		if f == nil {
+			return fmt.Errorf("invalid log descriptor %q", dest)
+		}
+	default:
+		var err error
+		if f, err = os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+			return err
+		}
+		opened = true
+	}
+
+	fi, err := f.Stat()
+	if err == nil {
+		if out, statErr := os.Stdout.Stat(); statErr == nil && os.SameFile(fi, out) {
+			err = errors.New("can't log to stdout, which carries the credential")
+		}
+	} else {
+		err = fmt.Errorf("can't log to %s: %w", dest, err)
+	}
+	if err != nil {
+		// An inherited descriptor isn't ours to close, and may be stdout
+		if opened {
+			f.Close()
+		}
+		return err
+	}
+	setLogOutput(f)
+	return nil
+}
+
+// setLogOutput points debugf at w, closing the file it wrote to before
+// unless that's stderr or the same descriptor.
+func setLogOutput(w io.Writer) {
+	prev, ok := logOutput.(*os.File)
+	logOutput = w
+	if !ok || prev == os.Stderr {
+		return
+	}
+	if next, ok := w.(*os.File); ok && next.Fd() == prev.Fd() {
+		return
+	}
+	prev.Close()
+}
+
+// applyLogConfig applies the logFile and logStderrLevel config. --log-file
+// takes precedence over logFile.
+func applyLogConfig() {
+	if logFile == "" {
+		if err := openLogOutput(gitCfg.Get(configKey("logfile"))); err != nil {
+			debugf(1, "Ignoring logFile: %v", err)
+		}
+	}
+	if value := strings.TrimSpace(gitCfg.Get(configKey("logstderrlevel"))); value != "" {
+		level, err := strconv.Atoi(value)
+		if err != nil {
+			debugf(1, "Ignoring invalid logStderrLevel: %q", value)
+		} else {
+			logStderrLevel = level
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogOutput(t *testing.T) {
+	defer func() {
+		setLogOutput(os.Stderr)
+		verbosity = 0
+	}()
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.log"), filepath.Join(dir, "second.log")
+
+	setTestConfig(t, "azureclicredentialhelper.logfile", first)
+	verbosity = 1
+	out := captureStdout(t, func() { debugf(1, "to the first log") })
+	if out != "" {
+		t.Errorf("debug output went to stdout: %q", out)
+	}
+	firstFile, ok := logOutput.(*os.File)
+	if !ok {
+		t.Fatalf("logOutput is %T, want the log file", logOutput)
+	}
+
+	setTestConfig(t, "azureclicredentialhelper.logfile", second)
+	debugf(1, "to the second log")
+	if _, err := firstFile.WriteString("x"); err == nil {
+		t.Error("reloading config left the previous log file open")
+	}
+	for path, want := range map[string]string{first: "to the first log", second: "to the second log"} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), want) || strings.Count(string(data), "[DEBUG]") != 1 {
+			t.Errorf("%s contains %q, want only %q", filepath.Base(path), data, want)
+		}
+	}
+
+	setTestConfig(t)
+	if logOutput != any(os.Stderr) {
+		t.Errorf("without logFile, logOutput is %v, want stderr", logOutput)
+	}
+}
@@ -32,16 +32,26 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
-	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/gopasspw/gitconfig"
 	"github.com/spf13/cobra"
 )
@@ -50,6 +60,13 @@ import (
 var version = ""
 
 func init() {
+	if prefix := strings.TrimSuffix(os.Getenv("AZURE_CLI_HELPER_CONFIG_PREFIX"), "."); prefix != "" {
+		configPrefix = prefix
+		configPrefixFromEnv = true
+	}
+	configPrefix = strings.ToLower(configPrefix)
+	standardConfigPrefix = configPrefix
+
 	if version == "" {
 		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
 			version = info.Main.Version
@@ -59,8 +76,63 @@ func init() {
 	}
 }
 
+// Section of all git config keys the helper reads. Forks and rebranded
+// builds can change it with -ldflags "-X main.configPrefix=<name>", and
+// AZURE_CLI_HELPER_CONFIG_PREFIX overrides it at runtime. Otherwise an
+// allowlisted invocation name can select another section (see
+// invocationPrefix). Git lowercases section names, so it's always used
+// lowercase.
+var configPrefix = "azureclicredentialhelper"
+
+// The section before any invocation name switch, which holds the
+// invocationSection allowlist, and whether the environment chose it
+var (
+	standardConfigPrefix string
+	configPrefixFromEnv  bool
+)
+
+// invocationPrefix returns the config section selected by the name the
+// binary was invoked as, so one binary symlinked as
+// git-credential-azure-devops and git-credential-azure-graph reads the
+// azure-devops and azure-graph sections. Only sections in allowed (the
+// invocationSection config) are selected, so renaming or copying the binary
+// can never silently drop the standard settings; the standard name and
+// release asset names like git-credential-azure-cli-linux-amd64 always use
+// the standard section. It returns "" when the section shouldn't change.
+func invocationPrefix(arg0 string, allowed []string) string {
+	name := strings.TrimSuffix(filepath.Base(arg0), ".exe")
+	section, ok := strings.CutPrefix(strings.ToLower(name), "git-credential-")
+	if !ok || section == "" || section == "azure-cli" || strings.HasPrefix(section, "azure-cli-") {
+		return ""
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(strings.TrimSpace(a), section) {
+			return section
+		}
+	}
+	return ""
+}
+
+// configKey returns the full git config key for a setting under the
+// helper's section.
+func configKey(name string) string {
+	return configPrefix + "." + name
+}
+
+// configName returns the key for a setting as shown to users: in the
+// documented camelCase for the default section, otherwise under whichever
+// section is in use.
+func configName(name string) string {
+	if configPrefix == "azureclicredentialhelper" {
+		return "azureCliCredentialHelper." + name
+	}
+	return configKey(name)
+}
+
 var defaultAllowedDomains = []string{"visualstudio.com", "dev.azure.com"}
 
+var defaultAllowedProtocols = []string{"https"}
+
 // Resource overrides for hosts that need a different token resource.
 // Configured via git config "azureCliCredentialHelper.<url>.resource" "<resourceURL>"
 var defaultResourceOverrides = map[string]string{}
@@ -69,16 +141,132 @@ var defaultResourceOverrides = map[string]string{}
 var (
 	gitCfg            *gitconfig.Configs
 	allowedDomains    []string
+	allowedProtocols  []string
+	allowedURLs       []string
 	resourceOverrides map[string]string
 	tenantOverrides   map[string]string
+	authTypeOverrides map[string]string
+	usernameOverrides map[string]string
+	claimsOverrides   map[string]string
+	permittedTenants  []string
+	outputFields      []string
+	passwordField     string
+
+	declineNegotiateOverrides  map[string]string
+	staticTokenOverrides       map[string]string
+	staticTokenExpiryOverrides map[string]string
+	enableCAEOverrides         map[string]string
+	resourceTenantOverrides    map[string]string
+	loginHintOverrides         map[string]string
+	authorityOverrides         map[string]string
+	basicUserOverrides         map[string]string
+
+	// Whether host-form overrides take precedence over URL-form ones
+	hostFirstOverrides bool
 )
 
 // Verbose level for debug output
 var verbosity int
 
+// Emit credentials on one semicolon-separated line instead of git's format
+var compactOutput bool
+
+// Git config scope that init writes to (global, system, local, or a file path)
+var configScope string
+
+// URL init enables credential.useHttpPath for ("*" for all URLs), so git
+// sends request paths for path-scoped overrides and allowedURL
+var useHTTPPath string
+
+// Whether init should fail unless a token can actually be acquired
+var requireAuth bool
+
+// Path init and exports register instead of the resolved executable, for
+// package managers that install a stable symlink or wrapper shim
+var exePathOverride string
+
+// Named log levels for --log-level and the logLevel config, mapped onto
+// verbosity. Warnings are logged at -v, alongside info.
+var logLevels = map[string]int{
+	"error": 0,
+	"warn":  1,
+	"info":  1,
+	"debug": 2,
+	"trace": 3,
+}
+
+// Value of --log-level, if given
+var logLevel string
+
+// How to encode the password field: "" (raw) or "base64", for transports
+// that mangle raw tokens
+var encodePassword string
+
+// raiseVerbosity applies a named log level, keeping verbosity at whichever
+// of it and the current (-v count) level is higher.
+func raiseVerbosity(name string) error {
+	level, ok := logLevels[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return fmt.Errorf("unknown log level %q (use error, warn, info, debug or trace)", name)
+	}
+	verbosity = max(verbosity, level)
+	return nil
+}
+
 func debugf(level int, format string, args ...interface{}) {
-	if verbosity >= level {
-		fmt.Fprintf(os.Stderr, "[DEBUG] "+format+"\n", args...)
+	if verbosity < level {
+		return
+	}
+	msg := fmt.Sprintf("[DEBUG] "+format+"\n", args...)
+	fmt.Fprint(logOutput, msg)
+	if logOutput != io.Writer(os.Stderr) && level <= logStderrLevel {
+		fmt.Fprint(os.Stderr, msg)
+	}
+}
+
+// Whether to print a timing breakdown of get to stderr
+var profileAcquisition bool
+
+// Whether get prints a one-line outcome summary to stderr
+var printSummary bool
+
+// Outcome of the last handleGet, for the summary line: emitted, failed, or
+// skipped-<reason>. Empty when get only printed diagnostics.
+var getResult string
+
+// Whether get only prints the resolved scope and tenant, without acquiring
+var printScope bool
+
+// Whether get only prints the parsed WWW-Authenticate challenge
+var printChallenge bool
+
+// stageTimer records how long each step of a get request takes, for
+// --profile-acquisition.
+type stageTimer struct {
+	last   time.Time
+	stages []string
+}
+
+func newStageTimer() *stageTimer {
+	return &stageTimer{last: time.Now()}
+}
+
+// mark records the time elapsed since the previous mark under the given name.
+func (t *stageTimer) mark(stage string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.stages = append(t.stages, fmt.Sprintf("%s: %v", stage, now.Sub(t.last).Round(time.Millisecond)))
+	t.last = now
+}
+
+func (t *stageTimer) report() {
+	if !profileAcquisition {
+		return
+	}
+	for _, stage := range t.stages {
+		fmt.Fprintf(os.Stderr, "[PROFILE] %s\n", stage)
 	}
 }
 
@@ -86,24 +274,99 @@ func loadConfig() {
 	debugf(2, "Loading git configuration")
 	gitCfg = gitconfig.New()
 	gitCfg.LoadAll("")
+	if !configPrefixFromEnv {
+		configPrefix = standardConfigPrefix
+		if section := invocationPrefix(os.Args[0], gitCfg.GetAll(standardConfigPrefix+".invocationsection")); section != "" {
+			configPrefix = section
+			debugf(2, "Using config section %s for invocation name %s", section, filepath.Base(os.Args[0]))
+		}
+	}
+	verifyIntegrity()
+	applyLogConfig()
+
+	if name := gitCfg.Get(configKey("loglevel")); name != "" {
+		if err := raiseVerbosity(name); err != nil {
+			debugf(1, "Ignoring logLevel: %v", err)
+		}
+	}
+
+	// Load allowed URL prefixes and domains (both support multiple values
+	// via --add), starting afresh so a reload doesn't keep old entries
+	allowedURLs, allowedDomains = nil, nil
+	for _, u := range gitCfg.GetAll(configKey("allowedurl")) {
+		if u = cleanConfigValue(u); u != "" {
+			allowedURLs = append(allowedURLs, u)
+		}
+	}
+	if len(allowedURLs) > 0 {
+		debugf(2, "Loaded allowed URLs from config: %v", allowedURLs)
+	}
 
-	// Load allowed domains (supports multiple values via --add)
 	// Git stores keys lowercase, so we use the lowercase version
-	domains := gitCfg.GetAll("azureclicredentialhelper.alloweddomain")
-	if len(domains) == 0 {
+	for _, d := range gitCfg.GetAll(configKey("alloweddomain")) {
+		if d = strings.TrimSpace(d); d != "" {
+			allowedDomains = append(allowedDomains, d)
+		}
+	}
+	switch {
+	case len(allowedDomains) > 0:
+		debugf(2, "Loaded allowed domains from config: %v", allowedDomains)
+	case len(allowedURLs) == 0:
+		// The default domains would make any allowedURL under them moot, so
+		// they only apply without one
 		allowedDomains = defaultAllowedDomains
 		debugf(2, "Using default allowed domains: %v", allowedDomains)
-	} else {
-		for _, d := range domains {
-			d = strings.TrimSpace(d)
-			if d != "" {
-				allowedDomains = append(allowedDomains, d)
-			}
+	}
+
+	// Load allowed protocols (supports multiple values via --add)
+	allowedProtocols = nil
+	for _, p := range gitCfg.GetAll(configKey("allowedprotocol")) {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			allowedProtocols = append(allowedProtocols, p)
+		}
+	}
+	if len(allowedProtocols) == 0 {
+		allowedProtocols = defaultAllowedProtocols
+	}
+	debugf(2, "Allowed protocols: %v", allowedProtocols)
+
+	outputFields = loadOutputFields(gitCfg.Get(configKey("outputfields")))
+
+	// Standard git requires exactly "password"; only nonstandard consumers
+	// should ever change this
+	passwordField = "password"
+	if field := strings.TrimSpace(gitCfg.Get(configKey("passwordfield"))); field != "" {
+		if strings.ContainsAny(field, "=\n") {
+			debugf(1, "Ignoring invalid passwordField: %q", field)
+		} else {
+			passwordField = field
+			debugf(2, "Emitting password as field: %s", passwordField)
 		}
-		if len(allowedDomains) == 0 {
-			allowedDomains = defaultAllowedDomains
+	}
+
+	switch precedence := strings.ToLower(strings.TrimSpace(gitCfg.Get(configKey("overrideprecedence")))); precedence {
+	case "", "url-first":
+		hostFirstOverrides = false
+	case "host-first":
+		hostFirstOverrides = true
+	default:
+		debugf(1, "Ignoring unknown overridePrecedence %q (use url-first or host-first)", precedence)
+		hostFirstOverrides = false
+	}
+
+	loadTransientErrorPatterns()
+
+	// Load the tenant allowlist. gitCfg only loads system, global and
+	// environment config (never a repository's .git/config), so a cloned
+	// repo cannot widen this list.
+	permittedTenants = nil
+	for _, t := range gitCfg.GetAll(configKey("permittedtenant")) {
+		if t = strings.TrimSpace(t); t != "" {
+			permittedTenants = append(permittedTenants, t)
 		}
-		debugf(2, "Loaded allowed domains from config: %v", allowedDomains)
+	}
+	if len(permittedTenants) > 0 {
+		debugf(2, "Loaded permitted tenants: %v", permittedTenants)
 	}
 
 	// Load resource overrides
@@ -117,32 +380,221 @@ func loadConfig() {
 	// Keys are in format: azureclicredentialhelper.<url>.tenant
 	tenantOverrides = make(map[string]string)
 
-	const prefix = "azureclicredentialhelper."
-	const resourceSuffix = ".resource"
-	const tenantSuffix = ".tenant"
+	// Load authtype overrides
+	// Keys are in format: azureclicredentialhelper.<url>.authtype
+	authTypeOverrides = make(map[string]string)
+
+	// Load username overrides
+	// Keys are in format: azureclicredentialhelper.<url>.username
+	usernameOverrides = make(map[string]string)
+
+	// Load usernames for tokens sent as Basic passwords
+	// Keys are in format: azureclicredentialhelper.<url>.basicusername
+	basicUserOverrides = make(map[string]string)
+
+	// Load claims overrides (base64-encoded claims JSON)
+	// Keys are in format: azureclicredentialhelper.<url>.claims
+	claimsOverrides = make(map[string]string)
+
+	// Load static test tokens (only honored with AZURE_CLI_HELPER_ALLOW_STATIC=1)
+	// Keys are in format: azureclicredentialhelper.<url>.statictoken and
+	// azureclicredentialhelper.<url>.statictokenexpiry
+	staticTokenOverrides = make(map[string]string)
+	staticTokenExpiryOverrides = make(map[string]string)
+
+	// Load hosts that should decline Negotiate-only challenges
+	// Keys are in format: azureclicredentialhelper.<url>.declinenegotiate
+	declineNegotiateOverrides = make(map[string]string)
+
+	// Load hosts that should request CAE-enabled tokens
+	// Keys are in format: azureclicredentialhelper.<url>.enablecae
+	enableCAEOverrides = make(map[string]string)
+
+	// Load tenants keyed by resource rather than by URL
+	// Keys are in format: azureclicredentialhelper.<resource>.resourcetenant
+	resourceTenantOverrides = make(map[string]string)
+
+	// Load the account (UPN) expected for each host
+	// Keys are in format: azureclicredentialhelper.<url>.loginhint
+	loginHintOverrides = make(map[string]string)
+
+	// Load the authority forced for each host when no tenant is configured
+	// Keys are in format: azureclicredentialhelper.<url>.authority
+	authorityOverrides = make(map[string]string)
+
+	// Per-URL settings share the same key layout and only differ in suffix.
+	// Git canonicalizes the final key component to lowercase. Settings that
+	// are written to git as credential fields are emitted.
+	prefix := configPrefix + "."
+	urlSettings := []struct {
+		suffix    string
+		overrides map[string]string
+		emitted   bool
+	}{
+		{".resource", resourceOverrides, false},
+		{".tenant", tenantOverrides, false},
+		{".authtype", authTypeOverrides, true},
+		{".username", usernameOverrides, true},
+		{".basicusername", basicUserOverrides, true},
+		{".claims", claimsOverrides, false},
+		{".statictoken", staticTokenOverrides, false},
+		{".statictokenexpiry", staticTokenExpiryOverrides, false},
+		{".declinenegotiate", declineNegotiateOverrides, false},
+		{".enablecae", enableCAEOverrides, false},
+		{".resourcetenant", resourceTenantOverrides, false},
+		{".loginhint", loginHintOverrides, false},
+		{".authority", authorityOverrides, false},
+	}
+	var entries []configEntry
 	for _, key := range gitCfg.List(prefix) {
-		if strings.HasSuffix(key, resourceSuffix) {
-			// Extract URL/host between prefix and suffix
-			urlPart := strings.TrimPrefix(key, prefix)
-			urlPart = strings.TrimSuffix(urlPart, resourceSuffix)
-			if urlPart != "" {
-				if resource := gitCfg.Get(key); resource != "" {
-					resourceOverrides[urlPart] = resource
-					debugf(2, "Loaded resource override: %s -> %s", urlPart, resource)
-				}
+		entries = append(entries, configEntry{key: key, value: gitCfg.Get(key)})
+	}
+
+	// Repository-local config is never read by default: a cloned repo could
+	// otherwise redirect token acquisition to a resource or tenant of its
+	// choosing. Users who trust their repos can opt in from global config.
+	if configBool(configKey("allowlocaloverrides"), false) {
+		localEntries, err := loadLocalConfigEntries(prefix)
+		if err != nil {
+			debugf(1, "Failed to load repository-local config: %v", err)
+		}
+		// Appended last so local values take precedence over global ones
+		entries = append(entries, localEntries...)
+	}
+
+	for _, entry := range entries {
+		for _, setting := range urlSettings {
+			if !strings.HasSuffix(entry.key, setting.suffix) {
+				continue
 			}
-		} else if strings.HasSuffix(key, tenantSuffix) {
 			// Extract URL/host between prefix and suffix
-			urlPart := strings.TrimPrefix(key, prefix)
-			urlPart = strings.TrimSuffix(urlPart, tenantSuffix)
-			if urlPart != "" {
-				if tenant := gitCfg.Get(key); tenant != "" {
-					tenantOverrides[urlPart] = tenant
-					debugf(2, "Loaded tenant override: %s -> %s", urlPart, tenant)
-				}
+			urlPart := strings.TrimPrefix(entry.key, prefix)
+			urlPart = strings.TrimSuffix(urlPart, setting.suffix)
+			value := cleanConfigValue(entry.value)
+			if value != entry.value {
+				debugf(2, "Trimmed whitespace or BOM from %s", entry.key)
+			}
+			// Like passwordField, an emitted value must not be able to
+			// inject extra fields into the credential output
+			if setting.emitted && strings.ContainsAny(value, "=\r\n") {
+				debugf(1, "Ignoring invalid %s%s: %q", entry.key, entry.source(), value)
+				break
 			}
+			if urlPart != "" && value != "" {
+				setting.overrides[overrideKey(urlPart)] = value
+				debugf(2, "Loaded %s override%s: %s -> %s", strings.TrimPrefix(setting.suffix, "."), entry.source(), urlPart, value)
+			}
+			break
+		}
+	}
+
+	loadRepoManifest()
+}
+
+// cleanConfigValue strips surrounding whitespace and byte order marks from
+// an override value. Hand-edited config files pick these up easily, and a
+// stray space in a resource or tenant otherwise surfaces as a baffling
+// AADSTS error.
+func cleanConfigValue(value string) string {
+	return strings.TrimFunc(value, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '\uFEFF'
+	})
+}
+
+// configEntry is a single key/value pair read from git config.
+type configEntry struct {
+	key   string
+	value string
+	local bool
+}
+
+func (e configEntry) source() string {
+	if e.local {
+		return " (repository-local)"
+	}
+	return ""
+}
+
+// loadLocalConfigEntries returns the keys under prefix from the current
+// repository's .git/config. gitCfg deliberately doesn't load that file, so
+// ask git directly. Returns nothing when not inside a repository.
+func loadLocalConfigEntries(prefix string) ([]configEntry, error) {
+	out, err := exec.Command("git", "config", "--local", "-z", "--get-regexp", "^"+regexp.QuoteMeta(prefix)).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			// Exit status 1 means no matching keys; outside a repository
+			// git exits with a different non-zero status. Neither is an error
+			// worth reporting.
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []configEntry
+	// With -z each entry is "key\nvalue" terminated by NUL
+	for _, record := range strings.Split(string(out), "\x00") {
+		if record == "" {
+			continue
 		}
+		key, value, _ := strings.Cut(record, "\n")
+		entries = append(entries, configEntry{key: key, value: value, local: true})
+	}
+	return entries, nil
+}
+
+// configBool reads a boolean git config value. Returns def if the key is
+// unset or unparseable.
+func configBool(key string, def bool) bool {
+	if !gitCfg.IsSet(key) {
+		return def
+	}
+	if b, ok := parseGitBool(gitCfg.Get(key)); ok {
+		return b
+	}
+	debugf(1, "Ignoring invalid boolean value for %s", key)
+	return def
+}
+
+// configDuration reads a duration from git config, accepting either a Go
+// duration ("90s", "2m") or a plain number of seconds. Returns def if the key
+// is unset or invalid.
+func configDuration(key string, def time.Duration) time.Duration {
+	value := strings.TrimSpace(gitCfg.Get(key))
+	if value == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d
+	}
+	debugf(1, "Ignoring invalid duration value for %s: %s", key, value)
+	return def
+}
+
+// parseGitBool parses a boolean using the same spellings as git itself.
+func parseGitBool(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "yes", "on", "1", "":
+		// A bare key with no value is true in git
+		return true, true
+	case "false", "no", "off", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// urlOverrideBool reads a boolean per-URL override, returning false if it
+// is unset or invalid.
+func urlOverrideBool(overrides map[string]string, protocol, host string) bool {
+	value, ok := lookupOverride(overrides, protocol, host)
+	if !ok {
+		return false
 	}
+	b, _ := parseGitBool(value)
+	return b
 }
 
 func isAllowedHost(host string, allowedDomains []string) bool {
@@ -156,39 +608,337 @@ func isAllowedHost(host string, allowedDomains []string) bool {
 	return false
 }
 
+// isAllowedURL reports whether a request's URL starts with one of the
+// allowed URL prefixes, on a path segment boundary: https://dev.azure.com/org
+// allows https://dev.azure.com/org/project but not
+// https://dev.azure.com/org2. The scheme and host compare
+// case-insensitively, the path exactly. Git only sends a path with
+// credential.useHttpPath, so without it only prefixes with no path match.
+func isAllowedURL(protocol, host, path string, allowedURLs []string) bool {
+	request := overrideKey(protocol + "://" + host + "/" + strings.Trim(path, "/"))
+	for _, allowed := range allowedURLs {
+		prefix := strings.TrimSuffix(overrideKey(allowed), "/")
+		if request == prefix || strings.HasPrefix(request, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedRequest reports whether the helper handles a request, by
+// allowedDomain or allowedURL.
+func isAllowedRequest(protocol, host, path string) bool {
+	return isAllowedHost(host, allowedDomains) || isAllowedURL(protocol, host, path, allowedURLs)
+}
+
+// Path of the request being handled (sent by git with
+// credential.useHttpPath), for path-scoped overrides. Set once per request
+// before any lookups.
+var requestPath string
+
+// overridePathPrefixes returns the path-scoped override keys to try for a
+// request path, most specific first. A trailing ".git" is ignored, and
+// Azure DevOps' "_git" segment is skipped, so for "org/project/_git/repo.git"
+// the candidates are "org/project/_git/repo", "org/project" and "org":
+// overrides keyed at the project or organization apply to its repos.
+func overridePathPrefixes(path string) []string {
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	if path == "" {
+		return nil
+	}
+	segments := strings.Split(path, "/")
+	var prefixes []string
+	for i := len(segments); i > 0; i-- {
+		if segments[i-1] == "_git" {
+			continue
+		}
+		prefixes = append(prefixes, strings.Join(segments[:i], "/"))
+	}
+	return prefixes
+}
+
+// overrideKey normalizes the URL or host part of an override key for
+// storage: the scheme and host are lowercased, since they're
+// case-insensitive and git keeps the case of config subsections, while a
+// path keeps its case. lookupOverride lowercases the request to match.
+func overrideKey(key string) string {
+	scheme, rest, hasScheme := strings.Cut(key, "://")
+	if !hasScheme {
+		scheme, rest = "", key
+	}
+	host, path, hasPath := strings.Cut(rest, "/")
+	key = strings.ToLower(host)
+	if hasPath {
+		key += "/" + path
+	}
+	if hasScheme {
+		key = strings.ToLower(scheme) + "://" + key
+	}
+	return key
+}
+
+// lookupOverride finds the per-URL override for a request in one of the
+// override maps loaded by loadConfig. Path-scoped keys
+// (https://dev.azure.com/org/project) are tried first, most specific first,
+// when git sent a path.
+//
+// When both a URL-form (https://yourproxy.yourdomain) and a host-form
+// (yourproxy.yourdomain) override exist, the URL form wins unless
+// azureCliCredentialHelper.overridePrecedence is "host-first".
+func lookupOverride(overrides map[string]string, protocol, host string) (string, bool) {
+	protocol, host = strings.ToLower(protocol), strings.ToLower(host)
+	keys := []string{fmt.Sprintf("%s://%s", protocol, host), host}
+	if hostFirstOverrides {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	var pathKeys []string
+	for _, prefix := range overridePathPrefixes(requestPath) {
+		pathKeys = append(pathKeys, fmt.Sprintf("%s://%s/%s", protocol, host, prefix))
+	}
+	for _, key := range append(pathKeys, keys...) {
+		if value, ok := overrides[key]; ok {
+			debugf(3, "Override matched key %q", key)
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// isPermittedTenant reports whether the helper may request a token for
+// tenant. With no allowlist configured every tenant is permitted. An empty
+// tenant means the Azure CLI's default tenant, which comes from the user's
+// own login rather than from config, so it is always permitted.
+func isPermittedTenant(tenant string, permitted []string) bool {
+	if len(permitted) == 0 || tenant == "" {
+		return true
+	}
+	for _, p := range permitted {
+		if strings.EqualFold(tenant, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupResourceOverride finds the resource override for a host. Precedence,
+// most specific first: exact URL, exact host, then each parent domain (URL
+// form before host form), then the wildcard key
+// azureclicredentialhelper.*.resource.
+func lookupResourceOverride(protocol, host string) (string, bool) {
+	highPolicy := policyTakesPrecedence()
+	if highPolicy {
+		if resource, ok := lookupPolicyResource(protocol, host); ok {
+			debugf(2, "Using resource from central policy")
+			return resource, true
+		}
+	}
+	if resource, ok := lookupOverride(resourceOverrides, protocol, host); ok {
+		return resource, true
+	}
+	parent := host
+	for {
+		_, rest, found := strings.Cut(parent, ".")
+		// Stop before reaching a bare TLD
+		if !found || !strings.Contains(rest, ".") {
+			break
+		}
+		parent = rest
+		if resource, ok := lookupOverride(resourceOverrides, protocol, parent); ok {
+			debugf(2, "Using resource override from parent domain %s", parent)
+			return resource, true
+		}
+	}
+	if resource, ok := resourceOverrides["*"]; ok {
+		debugf(2, "Using wildcard resource override")
+		return resource, true
+	}
+	if !highPolicy {
+		if resource, ok := lookupPolicyResource(protocol, host); ok {
+			debugf(2, "Using resource from central policy")
+			return resource, true
+		}
+	}
+	// The repository manifest has the lowest precedence of all
+	if resource, ok := lookupOverride(manifestResources, protocol, host); ok {
+		debugf(2, "Using resource from %s", manifestFileName)
+		return resource, true
+	}
+	return "", false
+}
+
 func getResourceForHost(protocol, host string) string {
-	url := fmt.Sprintf("%s://%s", protocol, host)
-	// Check for URL-based override first (e.g., https://yourproxy.yourdomain)
-	if resource, ok := resourceOverrides[url]; ok {
-		return resource
+	// Never build a resource like "https:///" from an empty host
+	if host == "" {
+		return ""
 	}
-	// Check for host-only override (e.g., yourproxy.yourdomain)
-	if resource, ok := resourceOverrides[host]; ok {
-		return resource
+	if resource, ok := lookupResourceOverride(protocol, host); ok {
+		return canonicalResource(resource)
 	}
-	return url + "/"
+	return canonicalResource(fmt.Sprintf("%s://%s", protocol, host))
 }
 
+// Azure DevOps' well-known resource (application) ID
+const azureDevOpsResource = "499b84ac-1321-427f-aa17-267ca6975798"
+
+// Resources that are almost certainly a copy-paste mistake when used for
+// certain hosts, and what was probably meant instead. Purely advisory.
+var resourceMismatches = []struct {
+	resourcePrefix string
+	hostSuffixes   []string
+	suggestion     string
+}{
+	{"https://graph.microsoft.com", []string{"dev.azure.com", "visualstudio.com"}, azureDevOpsResource},
+	{"https://management.azure.com", []string{"dev.azure.com", "visualstudio.com"}, azureDevOpsResource},
+}
+
+// warnResourceMismatch logs a warning when the resolved resource looks like
+// a misconfiguration for the host, e.g. a Graph resource for Azure DevOps,
+// which yields tokens the server rejects.
+func warnResourceMismatch(host, resource string) {
+	for _, m := range resourceMismatches {
+		if !strings.HasPrefix(strings.ToLower(resource), m.resourcePrefix) {
+			continue
+		}
+		if isAllowedHost(host, m.hostSuffixes) {
+			debugf(1, "Warning: resource %s is unlikely to work for %s; did you mean %s?", resource, host, m.suggestion)
+			return
+		}
+	}
+}
+
+// Hosts whose URL is itself a valid resource, so a host-derived resource is
+// expected to work without an override
+var hostDerivedResourceHosts = []string{"dev.azure.com", "visualstudio.com"}
+
+// warnHostDerivedResource logs a hint when a host without a resource
+// override isn't a service known to accept its own URL as the resource. The
+// resulting scope rarely matches a real Entra ID application, and the
+// failure that follows doesn't say so. Purely advisory.
+func warnHostDerivedResource(protocol, host string) {
+	if _, ok := lookupResourceOverride(protocol, host); ok || isAllowedHost(host, hostDerivedResourceHosts) {
+		return
+	}
+	debugf(1, "Warning: no resource override for %s, using the host URL as the resource; if token acquisition fails, set %s", host, configName(protocol+"://"+host+".resource"))
+}
+
+// getTenantForHost returns the tenant to request a token for a host in. A
+// tenant configured for the resource (audience) the host resolves to takes
+// precedence over URL/host tenant overrides, since in B2B setups the
+// resource determines the tenant; then the central policy (unless it's
+// configured to take precedence over everything) and the repository
+// manifest. Without any of those, an authority=organizations override asks
+// for the organizations tenant, so a work account is used even when a
+// personal one is signed in too.
 func getTenantForHost(protocol, host string) string {
-	url := fmt.Sprintf("%s://%s", protocol, host)
-	// Check for URL-based override first (e.g., https://yourproxy.yourdomain)
-	if tenant, ok := tenantOverrides[url]; ok {
+	tenant := lookupTenantForHost(protocol, host)
+	if tenant != "" {
 		return tenant
 	}
-	// Check for host-only override (e.g., yourproxy.yourdomain)
-	if tenant, ok := tenantOverrides[host]; ok {
-		return tenant
+	if authority, ok := lookupOverride(authorityOverrides, protocol, host); ok {
+		switch authority = strings.ToLower(strings.TrimSpace(authority)); authority {
+		case "organizations":
+			debugf(2, "Using the organizations authority for %s", host)
+			return authority
+		case "common", "":
+		default:
+			debugf(1, "Ignoring unknown authority %q for %s (use organizations or common)", authority, host)
+		}
 	}
 	return ""
 }
 
-func parseInput() (map[string]string, []string) {
-	data := make(map[string]string)
-	var wwwauth []string
+// lookupTenantForHost returns the tenant configured for a host, or "".
+func lookupTenantForHost(protocol, host string) string {
+	highPolicy := policyTakesPrecedence()
+	if highPolicy {
+		if tenant, ok := lookupPolicyTenant(protocol, host); ok {
+			return tenant
+		}
+	}
+	if tenant, ok := lookupResourceTenant(getResourceForHost(protocol, host)); ok {
+		return tenant
+	}
+	if tenant, ok := lookupOverride(tenantOverrides, protocol, host); ok {
+		return tenant
+	}
+	if !highPolicy {
+		if tenant, ok := lookupPolicyTenant(protocol, host); ok {
+			return tenant
+		}
+	}
+	tenant, _ := lookupOverride(manifestTenants, protocol, host)
+	return tenant
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+// lookupResourceTenant finds the tenant configured for a resource via
+// azureclicredentialhelper.<resource>.resourcetenant. Resources are compared
+// in canonical form, so trailing slashes and "/.default" don't matter.
+func lookupResourceTenant(resource string) (string, bool) {
+	if resource == "" {
+		return "", false
+	}
+	resource = canonicalResource(resource)
+	for key, tenant := range resourceTenantOverrides {
+		if strings.EqualFold(canonicalResource(key), resource) {
+			debugf(2, "Using tenant configured for resource %s", resource)
+			return tenant, true
+		}
+	}
+	return "", false
+}
+
+// getAuthTypeForHost returns the authtype to emit for a host. Defaults to
+// bearer, which is what Azure DevOps expects for Entra ID tokens.
+func getAuthTypeForHost(protocol, host string) string {
+	if authType, ok := lookupOverride(authTypeOverrides, protocol, host); ok {
+		return authType
+	}
+	return "bearer"
+}
+
+// getAuthTypeForRequest returns the authtype to emit for a request, or ""
+// to leave it out. Git only understands authtype when it advertises
+// capability[]=authtype; older git would otherwise send the token as a
+// Basic password anyway, so we degrade explicitly by omitting the line.
+// azureCliCredentialHelper.emitAuthType forces the behavior: "auto"
+// (default), "always" or "never".
+func getAuthTypeForRequest(protocol, host string, arrays map[string][]string) string {
+	switch mode := strings.ToLower(strings.TrimSpace(gitCfg.Get(configKey("emitauthtype")))); mode {
+	case "always":
+		return getAuthTypeForHost(protocol, host)
+	case "never":
+		debugf(2, "Omitting authtype (emitAuthType=never)")
+		return ""
+	default:
+		if mode != "" && mode != "auto" {
+			debugf(1, "Ignoring unknown emitAuthType %q (use auto, always or never)", mode)
+		}
+		if !slices.Contains(arrays["capability"], "authtype") {
+			debugf(2, "git didn't advertise capability[]=authtype, emitting the token as a plain password")
+			return ""
+		}
+		return getAuthTypeForHost(protocol, host)
+	}
+}
+
+// parseInput reads a credential request from stdin. Single-valued fields are
+// returned in data; array fields (sent by git as "key[]=value", such as
+// wwwauth[] and capability[]) are returned in arrays keyed without the
+// brackets. Unknown fields are preserved rather than rejected, since git
+// adds new ones over time.
+func parseInput(r io.Reader) (data map[string]string, arrays map[string][]string) {
+	data = make(map[string]string)
+	arrays = make(map[string][]string)
+
+	// Read whole lines however long they are: a bufio.Scanner stops at 64KB,
+	// and CAE claims challenges in wwwauth[] can get close to that
+	reader := bufio.NewReader(r)
+	for {
+		raw, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			debugf(1, "Error reading input: %v", err)
+		}
+		line := strings.TrimSpace(raw)
 		if line == "" {
 			break
 		}
@@ -196,41 +946,186 @@ func parseInput() (map[string]string, []string) {
 		if idx := strings.Index(line, "="); idx != -1 {
 			key := line[:idx]
 			value := line[idx+1:]
-			if key == "wwwauth[]" {
-				wwwauth = append(wwwauth, value)
+			if name, isArray := strings.CutSuffix(key, "[]"); isArray {
+				// Per the credential protocol an empty value clears the array
+				if value == "" {
+					delete(arrays, name)
+				} else {
+					arrays[name] = append(arrays[name], value)
+				}
 			} else {
 				data[key] = value
 			}
 			debugf(3, "Parsed input: %s=%s", key, value)
 		}
+		if err != nil {
+			break
+		}
 	}
 
-	return data, wwwauth
+	return data, arrays
+}
+
+// wwwAuthChallenge holds the parameters we use from the WWW-Authenticate
+// challenges git forwards in wwwauth[].
+type wwwAuthChallenge struct {
+	Realm string
+	// AuthorizationURI and Scope are what Entra ID-protected servers
+	// advertise for obtaining a token; informational only
+	AuthorizationURI string
+	Scope            string
+	// Claims is the base64-encoded claims challenge, if the server sent one
+	Claims string
+	// Error and ErrorDescription explain why the server rejected the
+	// previous credential (RFC 6750), e.g. an expired token or wrong audience
+	Error            string
+	ErrorDescription string
+}
+
+// describeError returns the server's explanation of the challenge, or "" if
+// it didn't give one.
+func (c wwwAuthChallenge) describeError() string {
+	switch {
+	case c.Error != "" && c.ErrorDescription != "":
+		return c.Error + ": " + c.ErrorDescription
+	case c.Error != "":
+		return c.Error
+	default:
+		return c.ErrorDescription
+	}
 }
 
-func extractRealm(wwwauthEntries []string) string {
-	re := regexp.MustCompile(`realm="([^"]+)"`)
+var challengeParamRe = regexp.MustCompile(`([A-Za-z_]+)="([^"]*)"`)
+
+// parseWWWAuth extracts challenge parameters from the wwwauth[] entries. If
+// a parameter appears in several challenges the first one wins.
+func parseWWWAuth(wwwauthEntries []string) wwwAuthChallenge {
+	var c wwwAuthChallenge
 	for _, entry := range wwwauthEntries {
-		matches := re.FindStringSubmatch(entry)
-		if len(matches) > 1 {
-			return matches[1]
+		for _, m := range challengeParamRe.FindAllStringSubmatch(entry, -1) {
+			switch strings.ToLower(m[1]) {
+			case "realm":
+				if c.Realm == "" {
+					c.Realm = m[2]
+				}
+			case "claims":
+				if c.Claims == "" {
+					c.Claims = m[2]
+				}
+			case "authorization_uri":
+				if c.AuthorizationURI == "" {
+					c.AuthorizationURI = m[2]
+				}
+			case "scope":
+				if c.Scope == "" {
+					c.Scope = m[2]
+				}
+			case "error":
+				if c.Error == "" {
+					c.Error = m[2]
+				}
+			case "error_description":
+				if c.ErrorDescription == "" {
+					c.ErrorDescription = m[2]
+				}
+			}
+		}
+	}
+	return c
+}
+
+// decodeClaims decodes a base64 claims value, as sent in claims challenges
+// and configured via .claims, into the JSON that GetToken expects.
+func decodeClaims(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := enc.DecodeString(value); err == nil {
+			if !json.Valid(decoded) {
+				return "", errors.New("claims are not valid JSON")
+			}
+			return string(decoded), nil
 		}
 	}
+	return "", errors.New("claims are not valid base64")
+}
+
+// tokenRequest holds per-request options passed through to GetToken.
+type tokenRequest struct {
+	claims    string
+	enableCAE bool
+}
+
+// getClaimsForRequest returns the claims to request, preferring a claims
+// challenge from the server over claims configured for the host via
+// azureclicredentialhelper.<url>.claims. Claims are logged by source only,
+// never by content.
+func getClaimsForRequest(protocol, host string, challenge wwwAuthChallenge) string {
+	if challenge.Claims != "" {
+		claims, err := decodeClaims(challenge.Claims)
+		if err == nil {
+			debugf(1, "Applying claims from the server's claims challenge")
+			return claims
+		}
+		debugf(1, "Ignoring claims challenge: %v", err)
+	}
+	if value, ok := lookupOverride(claimsOverrides, protocol, host); ok {
+		claims, err := decodeClaims(value)
+		if err == nil {
+			debugf(1, "Applying claims configured for %s", host)
+			return claims
+		}
+		debugf(1, "Ignoring claims configured for %s: %v", host, err)
+	}
 	return ""
 }
 
-func getAccessToken(ctx context.Context, cred *azidentity.AzureCLICredential, resource string) (string, int64, error) {
-	// Convert resource to scope format (.default suffix)
-	scope := resource
-	if !strings.HasSuffix(scope, "/") {
-		scope = scope + "/"
+// isNegotiateOnly reports whether the server's challenges only offer
+// Negotiate (Kerberos/NTLM) authentication, as on-prem Azure DevOps Server
+// commonly does. An Entra ID bearer token would just be rejected there.
+func isNegotiateOnly(wwwauthEntries []string) bool {
+	if len(wwwauthEntries) == 0 {
+		return false
 	}
-	scope = scope + ".default"
+	for _, entry := range wwwauthEntries {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(entry), " ")
+		if !strings.EqualFold(scheme, "Negotiate") && !strings.EqualFold(scheme, "NTLM") {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalResource is the single normalization point for resources
+// (audiences), whether configured or derived from the host: surrounding
+// whitespace, a "/.default" scope suffix and trailing slashes are removed,
+// so "https://host", "https://host/" and "https://host/.default" are all the
+// same resource. This is also the form az receives as --resource.
+func canonicalResource(resource string) string {
+	r := strings.TrimSpace(resource)
+	r = strings.TrimSuffix(r, "/.default")
+	return strings.TrimRight(r, "/")
+}
+
+// buildScope turns a resource (audience) into a scope by appending suffix
+// with exactly one "/" separator. Audiences that already end in the suffix
+// are normalized the same way rather than getting it appended twice, and
+// api:// and bare GUID audiences are handled like any other.
+func buildScope(resource, suffix string) string {
+	base := strings.TrimSuffix(strings.TrimSpace(resource), "/"+suffix)
+	return canonicalResource(base) + "/" + suffix
+}
+
+func getAccessToken(ctx context.Context, cred azcore.TokenCredential, resource string, req tokenRequest) (string, int64, error) {
+	// Convert resource to scope format (.default suffix)
+	scope := buildScope(resource, ".default")
 
 	debugf(2, "Requesting token for scope: %s", scope)
+	debugf(3, "GetToken options: scopes=[%s] claims=%t cae=%t", scope, req.claims != "", req.enableCAE)
 
 	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{
-		Scopes: []string{scope},
+		Scopes:    []string{scope},
+		Claims:    req.claims,
+		EnableCAE: req.enableCAE,
 	})
 	if err != nil {
 		debugf(1, "Failed to get token: %v", err)
@@ -238,83 +1133,625 @@ func getAccessToken(ctx context.Context, cred *azidentity.AzureCLICredential, re
 	}
 
 	debugf(2, "Token acquired, expires at: %v", token.ExpiresOn)
-	return token.Token, token.ExpiresOn.Unix(), nil
+	return token.Token, expiryUnix(token.ExpiresOn), nil
+}
+
+// expiryUnix converts a token expiry to the Unix seconds we emit as
+// password_expiry_utc, rounding any fractional second down so git never
+// believes a token is valid past its real expiry. A zero time (no expiry
+// reported) becomes 0 rather than a year-1 timestamp, so it's treated as
+// missing.
+func expiryUnix(expiresOn time.Time) int64 {
+	if expiresOn.IsZero() {
+		return 0
+	}
+	// Unix() truncates toward zero, which is rounding down for any date
+	// after 1970
+	if secs := expiresOn.Unix(); secs > 0 {
+		return secs
+	}
+	return 0
+}
+
+// getUsernameForHost returns the username to emit for a host. Azure DevOps
+// ignores the username for bearer tokens, so the default is a placeholder;
+// other Entra ID-protected hosts (e.g. behind App Proxy) may expect a
+// specific value.
+func getUsernameForHost(protocol, host string) string {
+	if username, ok := lookupOverride(usernameOverrides, protocol, host); ok {
+		return username
+	}
+	return "null"
+}
+
+// getUsernameForRequest returns the username to emit alongside authType.
+// When the token will go out as a Basic password (no authtype, or "basic"),
+// a host's basicUsername takes precedence, for integrations that bridge
+// tokens into a PAT-style Basic flow and check the username.
+func getUsernameForRequest(protocol, host, authType string) string {
+	if authType == "" || strings.EqualFold(authType, "basic") {
+		if username, ok := lookupOverride(basicUserOverrides, protocol, host); ok {
+			debugf(2, "Using basicUsername %s for Basic auth", username)
+			return username
+		}
+	}
+	return getUsernameForHost(protocol, host)
+}
+
+// Fields outputCredential can emit. protocol, host and path are echoed
+// from the request and are only emitted if listed in outputFields.
+var knownOutputFields = []string{"protocol", "host", "path", "url", "username", "password", "authtype", "password_expiry_utc"}
+
+// Default output fields, in order
+var defaultOutputFields = []string{"authtype", "username", "password", "password_expiry_utc"}
+
+// loadOutputFields parses the comma-separated outputFields config, dropping
+// (with a warning) any field we don't know how to emit.
+func loadOutputFields(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return defaultOutputFields
+	}
+	var fields []string
+	for _, f := range strings.Split(value, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if !slices.Contains(knownOutputFields, f) {
+			debugf(1, "Ignoring unknown output field %q (known fields: %s)", f, strings.Join(knownOutputFields, ","))
+			continue
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return defaultOutputFields
+	}
+	return fields
 }
 
-func outputCredential(accessToken string, expiryUTC int64) {
-	fmt.Println("authtype=bearer")
-	fmt.Println("username=null")
-	fmt.Printf("password=%s\n", accessToken)
+// credentialFields assembles every field we could emit for a request.
+// protocol, host and path are echoed exactly as git sent them: strict
+// proxies compare them case-sensitively, so the lowercased forms used for
+// matching in isAllowedHost and override lookups must never leak out here.
+func credentialFields(data map[string]string, authType, username, accessToken string, expiryUTC int64) map[string]string {
+	fields := map[string]string{
+		"protocol": data["protocol"],
+		"host":     data["host"],
+		"path":     data["path"],
+		"url":      requestURL(data),
+		"authtype": authType,
+		"username": username,
+		"password": accessToken,
+	}
 	if expiryUTC > 0 {
-		fmt.Printf("password_expiry_utc=%d\n", expiryUTC)
+		fields["password_expiry_utc"] = strconv.FormatInt(expiryUTC, 10)
+	}
+	return fields
+}
+
+// requestURL reconstructs the request's URL from its protocol, host, and
+// path, for helpers that emit url= instead of the individual fields.
+func requestURL(data map[string]string) string {
+	if data["protocol"] == "" || data["host"] == "" {
+		return ""
+	}
+	u := url.URL{Scheme: data["protocol"], Host: data["host"]}
+	if path := data["path"]; path != "" {
+		u.Path = "/" + strings.TrimPrefix(path, "/")
+	}
+	return u.String()
+}
+
+// outputCredential writes the configured output fields, in order, skipping
+// any that are empty. In compact mode they're written on a single line,
+// separated by semicolons and without a trailing newline, for embedding
+// wrappers; that is not the git credential protocol.
+func outputCredential(fields map[string]string) {
+	var lines []string
+	for _, name := range outputFields {
+		if value := fields[name]; value != "" {
+			if name == "password" {
+				name = passwordField
+				if encodePassword == "base64" {
+					value = "base64:" + base64.StdEncoding.EncodeToString([]byte(value))
+				}
+			}
+			lines = append(lines, name+"="+value)
+		}
+	}
+	if compactOutput {
+		fmt.Print(strings.Join(lines, ";"))
+		return
+	}
+	for _, line := range lines {
+		fmt.Println(line)
 	}
 }
 
 func getCredential(cmd *cobra.Command, args []string) {
+	timer := newStageTimer()
+	defer timer.report()
+
 	// Load configuration
 	loadConfig()
+	timer.mark("config load")
 
-	data, wwwauth := parseInput()
+	data, arrays := parseInput(os.Stdin)
+	timer.mark("read input")
 
+	if recursiveInvocation {
+		debugf(1, "Invoked from within another run of this helper (%s=1), skipping to avoid recursion", activeEnvVar)
+		return
+	}
+
+	err := handleGet(data, arrays, acquireToken, timer)
+	if printSummary || configBool(configKey("summary"), false) {
+		if getResult != "" {
+			fmt.Fprintf(os.Stderr, "git-credential-azure-cli: host=%s result=%s\n", data["host"], getResult)
+		}
+	}
+	if errors.Is(err, errCredentialSetup) {
+		os.Exit(1)
+	}
+}
+
+// storeCommand handles git's store request, sent after a credential worked.
+// get already saved the token in the token cache when it acquired it, so
+// there's nothing to store; the request is read so git never blocks
+// writing it.
+func storeCommand(cmd *cobra.Command, args []string) {
+	data, _ := parseInput(os.Stdin)
+	debugf(2, "Ignoring store request for %s://%s (expiry %s)", data["protocol"], data["host"], data["password_expiry_utc"])
+}
+
+// eraseCommand handles git's erase request, sent after a credential was
+// rejected, by dropping the host's token from the token cache so the next
+// get asks for a fresh one instead of serving the rejected token again.
+func eraseCommand(cmd *cobra.Command, args []string) {
+	loadConfig()
+	data, _ := parseInput(os.Stdin)
+	protocol, host := data["protocol"], data["host"]
+	requestPath = data["path"]
+	if host == "" || !isAllowedRequest(protocol, host, requestPath) || !tokenCacheEnabled() {
+		debugf(2, "Ignoring erase request for %s://%s", protocol, host)
+		return
+	}
+	resource := getResourceForHost(protocol, host)
+	if resource == "" {
+		return
+	}
+	debugf(1, "Erasing cached token for %s://%s", protocol, host)
+	eraseCachedToken(resource, getTenantForHost(protocol, host))
+}
+
+// lookupOfflineToken returns the cached token for a host, if the token
+// cache is enabled and has one, without touching the credential.
+func lookupOfflineToken(protocol, host string) (string, int64, bool) {
+	if !tokenCacheEnabled() {
+		return "", 0, false
+	}
+	resource := getResourceForHost(protocol, host)
+	if resource == "" {
+		return "", 0, false
+	}
+	tenant := getTenantForHost(protocol, host)
+	if !isPermittedTenant(tenant, permittedTenants) {
+		return "", 0, false
+	}
+	return lookupCachedToken(resource, tenant)
+}
+
+// tokenAcquirer has acquireToken's signature, so replay can substitute a
+// fake credential.
+type tokenAcquirer func(ctx context.Context, protocol, host string, wwwauth []string, timer *stageTimer) (string, int64, error)
+
+// handleGet answers one parsed get request, writing the credential (if any)
+// to stdout. Requests we don't handle produce no output and no error. It
+// returns the acquisition error, if any.
+func handleGet(data map[string]string, arrays map[string][]string, acquire tokenAcquirer, timer *stageTimer) error {
+	wwwauth := arrays["wwwauth"]
 	protocol := data["protocol"]
 	host := data["host"]
+	requestPath = data["path"]
+	getResult = ""
+
+	if host == "" {
+		debugf(1, "No host in request, skipping")
+		getResult = "skipped-no-host"
+		return nil
+	}
+
+	// Requests for hosts we don't handle are routine (every non-Azure remote
+	// triggers one), so they're only logged at -vv to keep -v actionable
+	debugf(2, "Received get request for %s://%s", protocol, host)
+
+	// Only handle allowed protocols (HTTPS unless configured otherwise)
+	if !slices.Contains(allowedProtocols, strings.ToLower(protocol)) {
+		debugf(2, "Skipping protocol not in allowed protocols: %s", protocol)
+		getResult = "skipped-protocol"
+		return nil
+	}
+
+	// Check if host is in allowed domains, or the URL under an allowed URL
+	if !isAllowedRequest(protocol, host, requestPath) {
+		debugf(2, "Host not in allowed domains or URLs: %s", host)
+		getResult = "skipped-not-allowed"
+		return nil
+	}
 
 	debugf(1, "Handling get request for %s://%s", protocol, host)
 
-	// Only handle HTTPS
-	if protocol != "https" {
-		debugf(1, "Skipping non-HTTPS protocol: %s", protocol)
+	// Show what the server asked for or what would be requested, without
+	// calling az or emitting anything on stdout
+	if printChallenge {
+		printWWWAuth(wwwauth)
+		return nil
+	}
+	if printScope {
+		printResolution(protocol, host)
+		return nil
+	}
+
+	// Let a Negotiate-capable helper handle Azure DevOps Server hosts that
+	// don't accept Entra ID tokens
+	if isNegotiateOnly(wwwauth) && urlOverrideBool(declineNegotiateOverrides, protocol, host) {
+		debugf(1, "Server only offers Negotiate authentication for %s, declining", host)
+		getResult = "skipped-negotiate"
+		return nil
+	}
+
+	// An earlier helper in the chain may already have supplied a secret.
+	// By default we replace it with our own token; with overwriteExisting
+	// disabled we leave it alone.
+	if (data["password"] != "" || data["credential"] != "") && !configBool(configKey("overwriteexisting"), true) {
+		debugf(1, "Credential already present for %s, not overwriting", host)
+		getResult = "skipped-existing"
+		return nil
+	}
+
+	// Static tokens let test harnesses exercise the full git credential
+	// flow without Entra ID. The env var gate keeps a stray config entry
+	// from ever taking effect in normal use.
+	if staticToken, ok := lookupOverride(staticTokenOverrides, protocol, host); ok {
+		if os.Getenv("AZURE_CLI_HELPER_ALLOW_STATIC") != "1" {
+			debugf(1, "Ignoring staticToken for %s: AZURE_CLI_HELPER_ALLOW_STATIC=1 is not set", host)
+		} else {
+			debugf(1, "Using static test token for %s", host)
+			var expiryUTC int64
+			if expiry, ok := lookupOverride(staticTokenExpiryOverrides, protocol, host); ok {
+				expiryUTC, _ = strconv.ParseInt(expiry, 10, 64)
+			}
+			authType := getAuthTypeForRequest(protocol, host, arrays)
+			outputCredential(credentialFields(data, authType, getUsernameForRequest(protocol, host, authType), staticToken, expiryUTC))
+			auditGet(protocol, host, nil)
+			getResult = "emitted"
+			return nil
+		}
+	}
+
+	// On flaky VPNs, skip hosts we can't reach at all so a VPN-aware helper
+	// later in the chain gets a turn sooner, without minting a token
+	if configBool(configKey("reachabilitycheck"), false) && !isHostReachable(protocol, host) {
+		debugf(1, "Host %s is unreachable, skipping", host)
+		getResult = "skipped-unreachable"
+		return nil
+	}
+
+	// Offline, serve a cached token or skip right away, rather than make
+	// git wait out the full timeout and retries of a credential that can't
+	// reach Entra ID
+	var accessToken string
+	var expiryUTC int64
+	if configBool(configKey("offlinecheck"), false) && isOffline() {
+		token, expiry, ok := lookupOfflineToken(protocol, host)
+		if !ok {
+			debugf(1, "Network appears to be offline and no token is cached for %s, skipping", host)
+			getResult = "skipped-offline"
+			return nil
+		}
+		debugf(1, "Network appears to be offline, using the cached token for %s", host)
+		accessToken, expiryUTC = token, expiry
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), acquisitionTimeout())
+		defer cancel()
+		var err error
+		accessToken, expiryUTC, err = acquire(ctx, protocol, host, wwwauth, timer)
+		if err != nil {
+			// The server's reason for rejecting the previous credential is
+			// often more helpful than our own error
+			if desc := parseWWWAuth(wwwauth).describeError(); desc != "" {
+				debugf(1, "Server reported: %s", desc)
+				err = fmt.Errorf("%w (server reported: %s)", err, desc)
+			}
+			recordLastError(protocol, host, err)
+			auditGet(protocol, host, err)
+			getResult = "failed"
+			return err
+		}
+	}
+
+	// A broken az setup (e.g. a faulty extension) can report success with
+	// no token. That's not a normal skip, so make it diagnosable.
+	if accessToken == "" {
+		debugf(1, "Acquired empty token for %s, skipping", host)
+		recordLastError(protocol, host, errEmptyToken)
+		auditGet(protocol, host, errEmptyToken)
+		getResult = "failed"
+		return errEmptyToken
+	}
+
+	if loginHint, ok := lookupOverride(loginHintOverrides, protocol, host); ok {
+		debugf(2, "Checking token against loginHint %s", loginHint)
+		if err := checkLoginHint(accessToken, loginHint); err != nil {
+			debugf(1, "Not using token for %s: %v", host, err)
+			recordLastError(protocol, host, err)
+			auditGet(protocol, host, err)
+			getResult = "failed"
+			return err
+		}
+	}
+	if configBool(configKey("requireworkaccount"), false) {
+		if err := checkWorkAccount(accessToken); err != nil {
+			debugf(1, "Denied credential for %s: %v", host, err)
+			recordLastError(protocol, host, err)
+			auditGet(protocol, host, err)
+			getResult = "failed"
+			return err
+		}
+	}
+	debugf(1, "Successfully obtained credential")
+	if verbosity >= 1 {
+		checkClockSkew(accessToken)
+	}
+	expiryUTC = applyDefaultExpiry(expiryUTC)
+	authType := getAuthTypeForRequest(protocol, host, arrays)
+	outputCredential(credentialFields(data, authType, getUsernameForRequest(protocol, host, authType), accessToken, expiryUTC))
+	auditGet(protocol, host, nil)
+	getResult = "emitted"
+	return nil
+}
+
+// applyDefaultExpiry substitutes now + azureCliCredentialHelper.defaultExpiry
+// when the token source didn't give us a usable expiry, so git's cache
+// doesn't hold on to the token indefinitely. With no defaultExpiry set, the
+// expiry is left out of the output as before.
+func applyDefaultExpiry(expiryUTC int64) int64 {
+	if expiryUTC > 0 {
+		return expiryUTC
+	}
+	defaultExpiry := configDuration(configKey("defaultexpiry"), 0)
+	if defaultExpiry <= 0 {
+		debugf(1, "Token has no expiry, omitting password_expiry_utc")
+		return 0
+	}
+	debugf(1, "Token has no expiry, using defaultExpiry of %v", defaultExpiry)
+	return time.Now().Add(defaultExpiry).Unix()
+}
+
+// printWWWAuth writes the WWW-Authenticate challenges git forwarded, and
+// what parseWWWAuth made of them, to stderr for --print-challenge.
+func printWWWAuth(wwwauth []string) {
+	if len(wwwauth) == 0 {
+		fmt.Fprintln(os.Stderr, "No wwwauth[] challenges in the request")
 		return
 	}
+	for _, entry := range wwwauth {
+		fmt.Fprintf(os.Stderr, "wwwauth[]=%s\n", entry)
+	}
+	c := parseWWWAuth(wwwauth)
+	for _, field := range []struct{ name, value string }{
+		{"realm", c.Realm},
+		{"authorization_uri", c.AuthorizationURI},
+		{"scope", c.Scope},
+		{"claims", c.Claims},
+		{"error", c.Error},
+		{"error_description", c.ErrorDescription},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(os.Stderr, "%s=%s\n", field.name, field.value)
+		}
+	}
+	if c.Claims != "" {
+		if decoded, err := decodeClaims(c.Claims); err == nil {
+			fmt.Fprintf(os.Stderr, "claims (decoded)=%s\n", decoded)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "negotiate only=%t\n", isNegotiateOnly(wwwauth))
+}
 
-	// Check if host is in allowed domains
-	if !isAllowedHost(host, allowedDomains) {
-		debugf(1, "Host not in allowed domains: %s", host)
+// printResolution writes the scope and tenant a request for host would use
+// to stderr, for --print-scope.
+func printResolution(protocol, host string) {
+	tenant := getTenantForHost(protocol, host)
+	tenantDesc := tenant
+	if tenant == "" {
+		tenantDesc = "default"
+	} else if !isPermittedTenant(tenant, permittedTenants) {
+		tenantDesc += " (not permitted)"
+	}
+	fmt.Fprintf(os.Stderr, "scope=%s\n", buildScope(getResourceForHost(protocol, host), ".default"))
+	fmt.Fprintf(os.Stderr, "tenant=%s\n", tenantDesc)
+}
+
+// recordLastError writes a failed get's error to the file named by
+// azureCliCredentialHelper.lastError, if set, overwriting the previous one.
+// get is silent on failure, so this is how a user finds out after the fact
+// why a fetch didn't authenticate. Replayed requests don't overwrite it.
+func recordLastError(protocol, host string, err error) {
+	path := gitCfg.Get(configKey("lasterror"))
+	if path == "" || replaying {
 		return
 	}
+	msg := fmt.Sprintf("%s %s://%s: %v\n", time.Now().UTC().Format(time.RFC3339), protocol, host, err)
+	if writeErr := os.WriteFile(path, []byte(msg), 0o600); writeErr != nil {
+		debugf(1, "Failed to write lastError file %s: %v", path, writeErr)
+	}
+}
+
+// errEmptyToken means the credential reported success but returned no
+// token, which points at a broken Azure CLI installation.
+var errEmptyToken = errors.New("credential returned an empty token; check the Azure CLI installation and extensions")
 
-	// Create Azure CLI credential with optional tenant override
-	ctx := context.Background()
+// errCredentialSetup wraps failures to construct a credential, which
+// indicate a configuration problem rather than a failed token request.
+var errCredentialSetup = errors.New("failed to create credential")
+
+// acquireToken obtains a token for an allowed host, applying the tenant and
+// resource overrides, retries, interactive re-login and the wwwauth realm
+// fallback. It's shared by get and the diagnostic subcommands so they
+// exercise the same path. timer may be nil.
+func acquireToken(ctx context.Context, protocol, host string, wwwauth []string, timer *stageTimer) (string, int64, error) {
+	// Create the credential with optional tenant override
 	tenant := getTenantForHost(protocol, host)
-	var credOpts *azidentity.AzureCLICredentialOptions
+	if !isPermittedTenant(tenant, permittedTenants) {
+		debugf(1, "Denied: tenant %s for %s is not in %s", tenant, host, configName("permittedTenant"))
+		return "", 0, fmt.Errorf("tenant %s is not permitted", tenant)
+	}
 	if tenant != "" {
 		debugf(1, "Using tenant override: %s", tenant)
-		credOpts = &azidentity.AzureCLICredentialOptions{
-			TenantID: tenant,
-		}
 	}
-	cred, err := azidentity.NewAzureCLICredential(credOpts)
+	cred, err := getCredentialForTenant(tenant)
 	if err != nil {
-		debugf(1, "Failed to create Azure CLI credential: %v", err)
-		os.Exit(1)
+		debugf(1, "Failed to create credential: %v", err)
+		return "", 0, fmt.Errorf("%w: %v", errCredentialSetup, err)
 	}
+	timer.mark("credential construction")
 
 	// Try getting token for the host (using override if available)
 	resource := getResourceForHost(protocol, host)
+	if resource == "" {
+		return "", 0, errors.New("no resource could be determined for the request")
+	}
 	debugf(1, "Using resource: %s", resource)
-	accessToken, expiryUTC, err := getAccessToken(ctx, cred, resource)
+	primaryResource := resource
+	warnResourceMismatch(host, resource)
+	warnHostDerivedResource(protocol, host)
+	challenge := parseWWWAuth(wwwauth)
+	req := tokenRequest{
+		claims:    getClaimsForRequest(protocol, host, challenge),
+		enableCAE: urlOverrideBool(enableCAEOverrides, protocol, host),
+	}
+	debugf(1, "CAE enabled for request: %t", req.enableCAE)
+
+	// A claims challenge means the server rejected the token we have, so
+	// only plain requests are served from or saved to the token cache
+	useCache := tokenCacheEnabled() && req.claims == ""
+	if useCache {
+		if token, expiry, ok := lookupCachedToken(resource, tenant); ok {
+			debugf(1, "Using cached token, expires at %v", time.Unix(expiry, 0))
+			timer.mark("token cache")
+			return token, expiry, nil
+		}
+	}
+	_, usingAzureCLI := cred.(*azureCLICredential)
+
+	// The Azure CLI credential can't pass claims to az, and fails telling
+	// the user to log in again with them. Do that for them when someone's at
+	// the terminal; afterwards az's plain token satisfies the challenge.
+	if usingAzureCLI && req.claims != "" {
+		claimsErr := &claimsChallengeError{tenant: tenant, claims: req.claims}
+		if !interactive || !canPromptUser() {
+			debugf(1, "Claims challenge needs az login --claims-challenge")
+			return "", 0, claimsErr
+		}
+		fmt.Fprintf(os.Stderr, "Azure CLI login required to satisfy the claims challenge from %s\n", host)
+		if loginErr := runAzLogin(tenant, req.claims); loginErr != nil {
+			debugf(1, "az login --claims-challenge failed: %v", loginErr)
+			return "", 0, claimsErr
+		}
+		timer.mark("az login (claims)")
+		loginCtx, loginCancel := context.WithTimeout(context.Background(), acquisitionTimeout())
+		defer loginCancel()
+		ctx = loginCtx
+		req.claims = ""
+	}
+
+	accessToken, expiryUTC, err := getAccessTokenWithRetry(ctx, cred, resource, req)
+	timer.mark("GetToken")
+
+	// If the az session has expired and a user is at the terminal, offer to
+	// log in again rather than failing the git operation
+	if err != nil && usingAzureCLI && interactive && isLoginRequired(err) && canPromptUser() {
+		fmt.Fprintf(os.Stderr, "Azure CLI login required for %s\n", host)
+		if loginErr := runAzLogin(tenant, ""); loginErr != nil {
+			debugf(1, "az login failed: %v", loginErr)
+		} else {
+			// The login may well have outlasted the original deadline
+			loginCtx, loginCancel := context.WithTimeout(context.Background(), acquisitionTimeout())
+			defer loginCancel()
+			ctx = loginCtx
+			accessToken, expiryUTC, err = getAccessTokenWithRetry(ctx, cred, resource, req)
+			timer.mark("GetToken (after login)")
+		}
+	}
+
+	// az can refuse to hand out a token when it can't pick a subscription,
+	// though the token doesn't depend on one. If allowed, pick one and retry.
+	if err != nil && usingAzureCLI && isSubscriptionError(err) && gitCfg.Get(configKey("subscription")) == "" {
+		if !configBool(configKey("autoselectsubscription"), false) {
+			debugf(1, "az failed over subscription selection; set %s or autoSelectSubscription", configName("subscription"))
+		} else if sub, subErr := firstSubscription(ctx, tenant); subErr != nil {
+			debugf(1, "Failed to pick a subscription: %v", subErr)
+		} else if subCred, credErr := newAzureCLICredential(tenant, sub); credErr != nil {
+			debugf(1, "Failed to create credential for subscription %s: %v", sub, credErr)
+		} else {
+			debugf(1, "az failed over subscription selection, retrying with subscription %s", sub)
+			cred = subCred
+			accessToken, expiryUTC, err = getAccessTokenWithRetry(ctx, cred, resource, req)
+			timer.mark("GetToken (subscription)")
+		}
+	}
 
 	// If that fails and no override was used, try using the realm from wwwauth
 	if err != nil {
-		url := fmt.Sprintf("%s://%s", protocol, host)
-		_, hasURLOverride := resourceOverrides[url]
-		_, hasHostOverride := resourceOverrides[host]
-		if !hasURLOverride && !hasHostOverride {
-			realm := extractRealm(wwwauth)
-			if realm != "" {
+		if _, hasOverride := lookupResourceOverride(protocol, host); !hasOverride {
+			if realm := challenge.Realm; realm != "" {
 				debugf(1, "Retrying with realm from wwwauth: %s", realm)
-				accessToken, expiryUTC, err = getAccessToken(ctx, cred, realm)
+				// Whatever comes back is a token for the realm, not for
+				// resource, so that's what it is cached under
+				resource = realm
+				if useCache {
+					if token, expiry, ok := lookupCachedToken(resource, tenant); ok {
+						debugf(1, "Using cached realm token, expires at %v", time.Unix(expiry, 0))
+						timer.mark("token cache (realm)")
+						return token, expiry, nil
+					}
+				}
+				accessToken, expiryUTC, err = getAccessTokenWithRetry(ctx, cred, resource, req)
+				timer.mark("GetToken (realm)")
 			}
 		}
 	}
 
-	if err == nil && accessToken != "" {
-		debugf(1, "Successfully obtained credential")
-		outputCredential(accessToken, expiryUTC)
+	if err == nil && accessToken != "" && useCache {
+		storeCachedToken(resource, tenant, accessToken, expiryUTC)
+	}
+
+	// If the token endpoint is down or throttling us, a cached token that's
+	// inside the refresh window but not about to expire still works
+	if err != nil && useCache {
+		if class, _ := classifyError(err); class == errorClassTransient || class == errorClassThrottled {
+			for _, r := range slices.Compact([]string{primaryResource, resource}) {
+				if token, expiry, ok := lookupCachedTokenValidFor(r, tenant, fallbackTokenSkew); ok {
+					debugf(1, "Acquisition failed with %s error, using the cached token that expires at %v", class, time.Unix(expiry, 0))
+					timer.mark("token cache (fallback)")
+					return token, expiry, nil
+				}
+			}
+		}
 	}
+	return accessToken, expiryUTC, err
 }
 
 func getExecutablePath() (string, error) {
+	override := exePathOverride
+	if override == "" {
+		override = os.Getenv("AZURE_CLI_HELPER_EXE_PATH")
+	}
+	if override != "" {
+		return validateExePath(override)
+	}
+
 	exe, err := os.Executable()
 	if err != nil {
 		return "", fmt.Errorf("failed to get executable path: %w", err)
@@ -327,6 +1764,55 @@ func getExecutablePath() (string, error) {
 	return exe, nil
 }
 
+// validateExePath checks that an --exe-path override is an executable file
+// and makes it absolute, without resolving symlinks: the point of the
+// override is to keep the path the user gave us.
+func validateExePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid executable path %s: %w", path, err)
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("invalid executable path: %w", err)
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("invalid executable path %s: is a directory", abs)
+	}
+	if runtime.GOOS != "windows" && fi.Mode()&0o111 == 0 {
+		return "", fmt.Errorf("invalid executable path %s: not executable", abs)
+	}
+	return abs, nil
+}
+
+// configScopeArgs translates the --scope flag value into the git config
+// arguments that select the target file: "global" (default), "system",
+// "local", or "file:<path>" for an arbitrary config file. Anything else is
+// rejected, so a typo doesn't quietly create a config file named after it.
+func configScopeArgs(scope string) ([]string, error) {
+	if path, ok := strings.CutPrefix(scope, "file:"); ok {
+		if path == "" {
+			return nil, errors.New("scope \"file:\" needs a path, e.g. file:/path/to/gitconfig")
+		}
+		return []string{"--file", path}, nil
+	}
+	switch scope {
+	case "", "global":
+		return []string{"--global"}, nil
+	case "system":
+		return []string{"--system"}, nil
+	case "local":
+		// git config --local fails with a fairly opaque message outside a
+		// repository, so check up front and give a clearer error.
+		if err := exec.Command("git", "rev-parse", "--git-dir").Run(); err != nil {
+			return nil, fmt.Errorf("scope \"local\" requires running inside a git repository")
+		}
+		return []string{"--local"}, nil
+	default:
+		return nil, fmt.Errorf("unknown scope %q (use global, system, local, or file:<path>)", scope)
+	}
+}
+
 func runGitConfig(args ...string) error {
 	cmd := exec.Command("git", args...)
 	cmd.Stdout = os.Stdout
@@ -402,38 +1888,137 @@ func initCommand(cmd *cobra.Command, args []string) {
 		fmt.Fprintf(os.Stderr, "\nPlease remove these entries from ~/.netrc to avoid authentication conflicts.\n\n")
 	}
 
+	scopeArgs, err := configScopeArgs(configScope)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	gitConfigArgs := func(args ...string) []string {
+		return append(append([]string{"config"}, scopeArgs...), args...)
+	}
+
+	if cacheHelperIsSelf(exePath) {
+		fmt.Fprintf(os.Stderr, "Error: the git cache credential helper resolves to this executable (%s); registering it would make the helper call itself\n", exePath)
+		os.Exit(1)
+	}
+
 	fmt.Println("Configuring git credential helpers...")
 
 	// Set cache helper first (replace any existing)
-	if err := runGitConfig("config", "--global", "--replace-all", "credential.helper", "cache"); err != nil {
+	if err := runGitConfig(gitConfigArgs("--replace-all", "credential.helper", "cache")...); err != nil {
 		fmt.Fprintf(os.Stderr, "Error setting cache helper: %v\n", err)
 		os.Exit(1)
 	}
 	fmt.Println("✓ Added cache credential helper")
 
 	// Add this helper
-	if err := runGitConfig("config", "--global", "--add", "credential.helper", exePath); err != nil {
+	if err := runGitConfig(gitConfigArgs("--add", "credential.helper", exePath)...); err != nil {
 		fmt.Fprintf(os.Stderr, "Error adding azure-cli helper: %v\n", err)
 		os.Exit(1)
 	}
 	fmt.Printf("✓ Added azure-cli credential helper: %s\n", exePath)
 
+	if useHTTPPath != "" {
+		key := "credential.useHttpPath"
+		if useHTTPPath != "*" {
+			key = "credential." + strings.TrimSuffix(useHTTPPath, "/") + ".useHttpPath"
+		}
+		if err := runGitConfig(gitConfigArgs(key, "true")...); err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting %s: %v\n", key, err)
+			os.Exit(1)
+		}
+		fmt.Printf("✓ Set %s\n", key)
+		fmt.Fprintf(os.Stderr, "⚠️  Git now caches credentials per repository path rather than per host, so each repository gets its own token.\n")
+	}
+
+	if requireAuth {
+		if err := checkTokenAcquisition("https", "dev.azure.com"); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: git is configured, but no token could be acquired for dev.azure.com: %v\n", err)
+			if guidance := loginGuidance(err); guidance != "" {
+				fmt.Fprintln(os.Stderr, guidance)
+			}
+			os.Exit(1)
+		}
+		fmt.Println("✓ Acquired a token for dev.azure.com")
+	}
+
 	fmt.Println("\nGit credential configuration complete!")
 }
 
+// uninstallCommand removes the credential.helper entry init added for this
+// executable from the --scope config. The cache helper and useHttpPath
+// settings are left alone, since they may predate init or serve other
+// helpers.
+func uninstallCommand(cmd *cobra.Command, args []string) {
+	exePath, err := getExecutablePath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	scopeArgs, err := configScopeArgs(configScope)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// git config matches the value as a regex, so match the path literally
+	gitArgs := append(append([]string{"config"}, scopeArgs...), "--unset-all", "credential.helper", "^"+regexp.QuoteMeta(exePath)+"$")
+	err = runGitConfig(gitArgs...)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 5 {
+		fmt.Printf("No credential.helper entry for %s found, nothing to remove\n", exePath)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error removing azure-cli helper: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✓ Removed azure-cli credential helper: %s\n", exePath)
+	fmt.Println("The cache credential helper and any credential.useHttpPath settings were left in place.")
+}
+
+// checkTokenAcquisition verifies end to end that a token can be acquired for
+// a host with the current configuration. The token itself is discarded.
+func checkTokenAcquisition(protocol, host string) error {
+	loadConfig()
+	ctx, cancel := context.WithTimeout(context.Background(), acquisitionTimeout())
+	defer cancel()
+	_, _, err := acquireToken(ctx, protocol, host, nil, nil)
+	return err
+}
+
 func exportsCommand(cmd *cobra.Command, args []string) {
+	loadConfig()
+	for _, w := range goauthWarnings() {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", w)
+	}
+
 	exePath, err := getExecutablePath()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
-	exeDir := filepath.Dir(exePath)
+	goauth, err := goauthValue(exePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
-	fmt.Printf("export GOAUTH=\"git %s\"\n", exeDir)
+	shell := exportsShell
+	if shell == "" {
+		shell = detectShell()
+	}
+	line, err := formatExport(strings.ToLower(shell), "GOAUTH", goauth)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(line)
 }
 
-func main() {
+// newRootCommand builds the command tree.
+func newRootCommand() *cobra.Command {
 	var rootCmd = &cobra.Command{
 		Use:   "git-credential-azure-cli",
 		Short: "Git credential helper using Azure CLI credentials",
@@ -442,6 +2027,22 @@ for Azure DevOps, Visual Studio, and other Azure-authenticated git services.
 
 When invoked as a git credential helper (with 'get' argument), it reads
 credential request from stdin and outputs bearer token credentials.`,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if encodePassword != "" && encodePassword != "base64" {
+				fmt.Fprintf(os.Stderr, "Error: unsupported --encode-password %q (only base64 is supported)\n", encodePassword)
+				os.Exit(1)
+			}
+			if logLevel != "" {
+				if err := raiseVerbosity(logLevel); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: ignoring --log-level: %v\n", err)
+				}
+			}
+			if logFile != "" {
+				if err := openLogOutput(logFile); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: ignoring --log-file: %v\n", err)
+				}
+			}
+		},
 		// Silently ignore unknown commands per git credential helper spec:
 		// "If it does not support the requested operation, it should silently ignore the request."
 		Run: func(cmd *cobra.Command, args []string) {
@@ -454,6 +2055,11 @@ credential request from stdin and outputs bearer token credentials.`,
 
 	// Add persistent verbose flag
 	rootCmd.PersistentFlags().CountVarP(&verbosity, "verbose", "v", "Increase verbosity (use -v, -vv, or -vvv)")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "Log level: error, warn, info, debug, or trace (alternative to -v)")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Write debug output to this file, or fd:N for an inherited descriptor, instead of stderr")
+	rootCmd.PersistentFlags().StringVar(&encodePassword, "encode-password", "", "Encode the emitted password: base64 emits password=base64:<encoded> (for embedding, not git)")
+	rootCmd.PersistentFlags().BoolVar(&compactOutput, "compact", false, "Emit credentials as a single key=value;key=value line (for embedding, not git)")
+	rootCmd.PersistentFlags().BoolVar(&interactive, "interactive", false, "Run az login on a terminal when the Azure CLI session has expired")
 
 	// Get command (for git credential helper protocol)
 	var getCmd = &cobra.Command{
@@ -463,6 +2069,10 @@ credential request from stdin and outputs bearer token credentials.`,
 		Hidden: true, // Hide from help since git calls this
 		Run:    getCredential,
 	}
+	getCmd.Flags().BoolVar(&printChallenge, "print-challenge", false, "Print the parsed WWW-Authenticate challenge to stderr, without acquiring a token")
+	getCmd.Flags().BoolVar(&printScope, "print-scope", false, "Print the scope and tenant that would be requested to stderr, without acquiring a token")
+	getCmd.Flags().BoolVar(&printSummary, "summary", false, "Print a one-line summary of the outcome to stderr")
+	getCmd.Flags().BoolVar(&profileAcquisition, "profile-acquisition", false, "Print a timing breakdown of credential acquisition to stderr")
 
 	// Init command
 	var initCmd = &cobra.Command{
@@ -473,9 +2083,32 @@ credential request from stdin and outputs bearer token credentials.`,
 1. Set the cache credential helper (to prevent rate limiting)
 2. Add this tool as a credential helper
 
-This modifies your global git configuration (~/.gitconfig).`,
+By default this modifies your global git configuration (~/.gitconfig).
+Use --scope to target the system config, the current repository's config
+(local), or an arbitrary config file path instead.`,
 		Run: initCommand,
 	}
+	initCmd.Flags().StringVar(&exePathOverride, "exe-path", "", "Register this path instead of the resolved executable (default $AZURE_CLI_HELPER_EXE_PATH)")
+	initCmd.Flags().BoolVar(&requireAuth, "require-auth", false, "Fail unless a token can be acquired after configuring git")
+	initCmd.Flags().StringVar(&useHTTPPath, "use-http-path", "", "Set credential.useHttpPath for this URL, or \"*\" for all URLs (flag alone: https://dev.azure.com)")
+	initCmd.Flags().Lookup("use-http-path").NoOptDefVal = "https://dev.azure.com"
+	initCmd.Flags().StringVar(&configScope, "scope", "global", "Git config scope to write to: global, system, local, or file:<path>")
+
+	// Uninstall command
+	var uninstallCmd = &cobra.Command{
+		Use:   "uninstall",
+		Short: "Remove this credential helper from git configuration",
+		Long: `Remove the credential.helper entry that init added for this executable.
+
+By default this modifies your global git configuration (~/.gitconfig).
+Use --scope and --exe-path with the same values given to init. The cache
+credential helper and credential.useHttpPath settings are left in place.`,
+		Args: cobra.NoArgs,
+		Run:  uninstallCommand,
+	}
+	uninstallCmd.Flags().StringVar(&exePathOverride, "exe-path", "", "Remove this path instead of the resolved executable (default $AZURE_CLI_HELPER_EXE_PATH)")
+	uninstallCmd.Flags().StringVar(&configScope, "scope", "global", "Git config scope to remove from: global, system, local, or file:<path>")
+	rootCmd.AddCommand(uninstallCmd)
 
 	// Exports command
 	var exportsCmd = &cobra.Command{
@@ -483,17 +2116,45 @@ This modifies your global git configuration (~/.gitconfig).`,
 		Short: "Output environment variable exports for GOAUTH",
 		Long: `Output shell export statements for configuring GOAUTH.
 
+The syntax matches your shell, detected from $SHELL (bash if unknown);
+use --shell to choose bash, zsh, fish, powershell, or cmd.
+
 Usage:
   # Add to your shell profile:
   git-credential-azure-cli exports >> ~/.bashrc
 
   # Or evaluate directly:
-  eval $(git-credential-azure-cli exports)`,
+  eval $(git-credential-azure-cli exports)
+
+  # fish:
+  git-credential-azure-cli exports --shell fish | source`,
 		Run: exportsCommand,
 	}
 
 	rootCmd.AddCommand(getCmd)
+
+	// Store and erase commands (git credential helper protocol)
+	var storeCmd = &cobra.Command{
+		Use:     "store",
+		Aliases: []string{"approve"},
+		Short:   "Accept a store request (no-op; get already cached the token)",
+		Hidden:  true,
+		Run:     storeCommand,
+	}
+	rootCmd.AddCommand(storeCmd)
+	var eraseCmd = &cobra.Command{
+		Use:     "erase",
+		Aliases: []string{"reject"},
+		Short:   "Drop a rejected token from the token cache",
+		Hidden:  true,
+		Run:     eraseCommand,
+	}
+	rootCmd.AddCommand(eraseCmd)
 	rootCmd.AddCommand(initCmd)
+	exportsCmd.Flags().StringVar(&goauthCmd, "goauth-cmd", "", "Emit this GOAUTH value verbatim instead of \"git <dir>\"")
+	exportsCmd.Flags().StringVar(&goauthDir, "goauth-dir", "", "Directory for the \"git <dir>\" GOAUTH form (default: the helper's directory)")
+	exportsCmd.Flags().StringVar(&exportsShell, "shell", "", "Shell syntax: bash, zsh, fish, powershell, or cmd (default: detect from $SHELL)")
+	exportsCmd.Flags().StringVar(&exePathOverride, "exe-path", "", "Use this path instead of the resolved executable (default $AZURE_CLI_HELPER_EXE_PATH)")
 	rootCmd.AddCommand(exportsCmd)
 
 	// Version command
@@ -507,9 +2168,106 @@ Usage:
 
 	rootCmd.AddCommand(versionCmd)
 
+	// Token command
+	var tokenCmd = &cobra.Command{
+		Use:   "token <url>",
+		Short: "Print an access token for a URL",
+		Long: `Acquire an access token for a URL using the same resource, tenant, and
+credential resolution as git's get requests, and print it to stdout.
+
+With --check, the token is never printed. Instead a single line
+"OK scope=<scope> tenant=<tenant> expires=<time>" confirms that the
+configuration can mint a token, for use as a CI gate. The exit code is
+non-zero on failure either way.`,
+		Args: cobra.ExactArgs(1),
+		Run:  tokenCommand,
+	}
+	tokenCmd.Flags().BoolVar(&tokenCheck, "check", false, "Validate acquisition and print a summary instead of the token")
+	tokenCmd.Flags().BoolVar(&profileAcquisition, "profile-acquisition", false, "Print a timing breakdown of credential acquisition to stderr")
+	rootCmd.AddCommand(tokenCmd)
+
+	// Migrate-netrc command
+	var migrateNetrcCmd = &cobra.Command{
+		Use:   "migrate-netrc",
+		Short: "Move hosts from ~/.netrc to this helper",
+		Long: `Find ~/.netrc entries for allowed domains (or, with --all, every entry) and
+suggest the changes needed to use this helper for them instead: adding the
+host to azureCliCredentialHelper.allowedDomain and commenting out the .netrc
+entry, which would otherwise take precedence.
+
+With --apply, the changes are made, after backing up .netrc to .netrc.bak.
+Passwords in .netrc are never printed.`,
+		Run: migrateNetrcCommand,
+	}
+	migrateNetrcCmd.Flags().BoolVar(&migrateApply, "apply", false, "Make the changes instead of printing them")
+	migrateNetrcCmd.Flags().BoolVar(&migrateAll, "all", false, "Migrate every .netrc entry, not just allowed domains")
+	rootCmd.AddCommand(migrateNetrcCmd)
+
+	// Replay command (diagnostic)
+	var replayCmd = &cobra.Command{
+		Use:   "replay <file>",
+		Short: "Run recorded credential requests and print the helper's output",
+		Long: `Read credential requests in git's key=value format, separated by blank
+lines, and run each through the same handling as get. The output for each
+request follows a "# request N" header; requests the helper would skip
+produce no output.
+
+With --fake, a placeholder token naming the resolved scope is used instead
+of contacting the Azure CLI, for regression-testing configuration.`,
+		Args: cobra.ExactArgs(1),
+		Run:  replayCommand,
+	}
+	replayCmd.Flags().BoolVar(&replayFake, "fake", false, "Use a placeholder token instead of acquiring one")
+	replayCmd.Flags().BoolVar(&profileAcquisition, "profile-acquisition", false, "Print a timing breakdown of each request's acquisition to stderr")
+	rootCmd.AddCommand(replayCmd)
+
+	// Cache command
+	var cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the on-disk token cache",
+	}
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "clear [host]",
+		Short: "Delete every cached token, or only a host's",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   cacheClearCommand,
+	})
+	cacheCmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List cached tokens by scope, tenant and expiry (tokens are never printed)",
+		Args:  cobra.NoArgs,
+		Run:   cacheListCommand,
+	})
+	rootCmd.AddCommand(cacheCmd)
+
+	// Stress command (diagnostic, hidden)
+	var stressCmd = &cobra.Command{
+		Use:   "stress <url>",
+		Short: "Run parallel token acquisitions to reproduce throttling",
+		Long: `Fire parallel token acquisitions for a host through the same path git's
+get requests use, then report success/failure counts, throttled responses,
+and latency percentiles. Tokens are never printed.
+
+The token cache is used as it is for git, so a warm cache shows what
+parallel fetches actually cost; --no-cache sends every acquisition to the
+token endpoint.`,
+		Args:   cobra.ExactArgs(1),
+		Hidden: true,
+		Run:    stressCommand,
+	}
+	stressCmd.Flags().IntVarP(&stressCount, "count", "n", 10, "Number of parallel acquisitions")
+	stressCmd.Flags().BoolVar(&bypassTokenCache, "no-cache", false, "Skip the token cache, so every acquisition reaches the token endpoint")
+	rootCmd.AddCommand(stressCmd)
+
+	return rootCmd
+}
+
+func main() {
+	markActive()
+
 	// Execute the command. Per git credential helper spec, unknown operations
 	// should be silently ignored with a successful exit code.
 	// Cobra returns an error for unknown subcommands, but we ignore it to
 	// comply with the spec: "it should silently ignore the request"
-	rootCmd.Execute()
+	newRootCommand().Execute()
 }
@@ -0,0 +1,930 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// setTestConfig loads config from kv (alternating keys and values) and
+// nothing else: system config is skipped and HOME points at an empty
+// directory.
+func setTestConfig(t *testing.T, kv ...string) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, ".cache"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("AZURE_CLI_HELPER_CACHE_DIR", "")
+	t.Setenv("GIT_CONFIG_COUNT", fmt.Sprint(len(kv)/2))
+	for i := 0; i+1 < len(kv); i += 2 {
+		t.Setenv(fmt.Sprintf("GIT_CONFIG_KEY_%d", i/2), kv[i])
+		t.Setenv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", i/2), kv[i+1])
+	}
+	loadConfig()
+}
+
+// setTestCredential makes cred the credential for tenant until the test ends.
+func setTestCredential(t *testing.T, tenant string, cred azcore.TokenCredential) {
+	t.Helper()
+	credentialsMu.Lock()
+	credentials[tenant] = cred
+	credentialsMu.Unlock()
+	t.Cleanup(func() {
+		credentialsMu.Lock()
+		delete(credentials, tenant)
+		credentialsMu.Unlock()
+	})
+}
+
+// captureStdout returns what fn writes to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stdout, fn)
+}
+
+// captureStderr returns what fn writes to stderr.
+func captureStderr(t *testing.T, fn func()) string {
+	t.Helper()
+	return captureFile(t, &os.Stderr, fn)
+}
+
+// captureFile returns what fn writes to *f, which is swapped for a pipe
+// while fn runs.
+func captureFile(t *testing.T, f **os.File, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := *f
+	*f = w
+	defer func() { *f = orig }()
+	fn()
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestOutputCredential(t *testing.T) {
+	fields := map[string]string{
+		"protocol":            "https",
+		"host":                "dev.azure.com",
+		"authtype":            "Bearer",
+		"username":            "user",
+		"password":            "token",
+		"password_expiry_utc": "1700000000",
+	}
+	tests := []struct {
+		name   string
+		config []string
+		fields map[string]string
+		want   string
+	}{
+		{
+			name:   "default fields",
+			fields: fields,
+			want:   "authtype=Bearer\nusername=user\npassword=token\npassword_expiry_utc=1700000000\n",
+		},
+		{
+			name:   "empty fields are skipped",
+			fields: map[string]string{"username": "user", "password": "token"},
+			want:   "username=user\npassword=token\n",
+		},
+		{
+			name:   "configured fields and order",
+			config: []string{"azureclicredentialhelper.outputfields", "password, host,bogus"},
+			fields: fields,
+			want:   "password=token\nhost=dev.azure.com\n",
+		},
+		{
+			name:   "password field renamed",
+			config: []string{"azureclicredentialhelper.outputfields", "password", "azureclicredentialhelper.passwordfield", "token"},
+			fields: fields,
+			want:   "token=token\n",
+		},
+		{
+			name:   "invalid password field rejected",
+			config: []string{"azureclicredentialhelper.outputfields", "password", "azureclicredentialhelper.passwordfield", "x=y"},
+			fields: fields,
+			want:   "password=token\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, tt.config...)
+			if got := captureStdout(t, func() { outputCredential(tt.fields) }); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmittedOverridesRejectInjection(t *testing.T) {
+	setTestConfig(t,
+		"azureclicredentialhelper.https://good.example.com.authtype", "Basic",
+		"azureclicredentialhelper.https://good.example.com.username", "alice",
+		"azureclicredentialhelper.https://bad.example.com.authtype", "Bearer\npassword=stolen",
+		"azureclicredentialhelper.https://bad.example.com.username", "a=b",
+		"azureclicredentialhelper.https://bad.example.com.basicusername", "bob\rpassword=x",
+	)
+	tests := []struct {
+		overrides map[string]string
+		host      string
+		want      string
+	}{
+		{authTypeOverrides, "good.example.com", "Basic"},
+		{usernameOverrides, "good.example.com", "alice"},
+		{authTypeOverrides, "bad.example.com", ""},
+		{usernameOverrides, "bad.example.com", ""},
+		{basicUserOverrides, "bad.example.com", ""},
+	}
+	for _, tt := range tests {
+		if got, _ := lookupOverride(tt.overrides, "https", tt.host); got != tt.want {
+			t.Errorf("override for %s = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestGetAuthTypeForHost(t *testing.T) {
+	setTestConfig(t,
+		"azureclicredentialhelper.https://basic.example.com.authtype", "Basic",
+		"azureclicredentialhelper.custom.example.com.authtype", "Negotiate",
+		"azureclicredentialhelper.https://dev.azure.com/org.authtype", "Basic",
+	)
+	defer func() { requestPath = "" }()
+	tests := []struct {
+		name string
+		host string
+		path string
+		want string
+	}{
+		{"default", "dev.azure.com", "", "bearer"},
+		{"url override", "basic.example.com", "", "Basic"},
+		{"host override", "custom.example.com", "", "Negotiate"},
+		{"path override", "dev.azure.com", "org/_git/repo", "Basic"},
+		{"other path keeps default", "dev.azure.com", "other/_git/repo", "bearer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestPath = tt.path
+			if got := getAuthTypeForHost("https", tt.host); got != tt.want {
+				t.Errorf("getAuthTypeForHost(%s/%s) = %q, want %q", tt.host, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInput(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantData   map[string]string
+		wantArrays map[string][]string
+	}{
+		{
+			name:     "basic request",
+			input:    "protocol=https\nhost=dev.azure.com\n\n",
+			wantData: map[string]string{"protocol": "https", "host": "dev.azure.com"},
+		},
+		{
+			name:     "no trailing blank line",
+			input:    "protocol=https\nhost=dev.azure.com",
+			wantData: map[string]string{"protocol": "https", "host": "dev.azure.com"},
+		},
+		{
+			name:     "CRLF line endings",
+			input:    "protocol=https\r\nhost=dev.azure.com\r\n\r\n",
+			wantData: map[string]string{"protocol": "https", "host": "dev.azure.com"},
+		},
+		{
+			name:     "stops at the blank line",
+			input:    "host=a\n\nhost=b\n",
+			wantData: map[string]string{"host": "a"},
+		},
+		{
+			name:     "value containing =",
+			input:    "path=org/_git/repo?x=y\n",
+			wantData: map[string]string{"path": "org/_git/repo?x=y"},
+		},
+		{
+			name:     "later value wins",
+			input:    "host=a\nhost=b\n",
+			wantData: map[string]string{"host": "b"},
+		},
+		{
+			name:     "line without =",
+			input:    "garbage\nhost=a\n",
+			wantData: map[string]string{"host": "a"},
+		},
+		{
+			name:       "arrays",
+			input:      "wwwauth[]=Bearer realm=\"x\"\nwwwauth[]=Basic\ncapability[]=authtype\n",
+			wantData:   map[string]string{},
+			wantArrays: map[string][]string{"wwwauth": {"Bearer realm=\"x\"", "Basic"}, "capability": {"authtype"}},
+		},
+		{
+			name:       "empty value clears an array",
+			input:      "wwwauth[]=Basic\nwwwauth[]=\nwwwauth[]=Bearer\n",
+			wantData:   map[string]string{},
+			wantArrays: map[string][]string{"wwwauth": {"Bearer"}},
+		},
+		{
+			name:     "empty input",
+			input:    "",
+			wantData: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, arrays := parseInput(strings.NewReader(tt.input))
+			if fmt.Sprint(data) != fmt.Sprint(tt.wantData) {
+				t.Errorf("data = %v, want %v", data, tt.wantData)
+			}
+			if tt.wantArrays == nil {
+				tt.wantArrays = map[string][]string{}
+			}
+			if fmt.Sprint(arrays) != fmt.Sprint(tt.wantArrays) {
+				t.Errorf("arrays = %v, want %v", arrays, tt.wantArrays)
+			}
+		})
+	}
+}
+
+func TestBuildScope(t *testing.T) {
+	tests := []struct {
+		resource string
+		suffix   string
+		want     string
+	}{
+		{"https://host", ".default", "https://host/.default"},
+		{"https://host/", ".default", "https://host/.default"},
+		{"https://host/.default", ".default", "https://host/.default"},
+		{"api://my-app", ".default", "api://my-app/.default"},
+		{"499b84ac-1321-427f-aa17-267ca6975798", ".default", "499b84ac-1321-427f-aa17-267ca6975798/.default"},
+		{"api://my-app/", "user_impersonation", "api://my-app/user_impersonation"},
+		{"api://my-app/user_impersonation", "user_impersonation", "api://my-app/user_impersonation"},
+	}
+	for _, tt := range tests {
+		if got := buildScope(tt.resource, tt.suffix); got != tt.want {
+			t.Errorf("buildScope(%q, %q) = %q, want %q", tt.resource, tt.suffix, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalResource(t *testing.T) {
+	tests := []struct {
+		resource string
+		want     string
+	}{
+		{"https://host", "https://host"},
+		{"https://host/", "https://host"},
+		{"https://host//", "https://host"},
+		{"https://host/.default", "https://host"},
+		{" https://host/.default \t", "https://host"},
+		{"api://my-app", "api://my-app"},
+		{"499b84ac-1321-427f-aa17-267ca6975798", "499b84ac-1321-427f-aa17-267ca6975798"},
+	}
+	for _, tt := range tests {
+		if got := canonicalResource(tt.resource); got != tt.want {
+			t.Errorf("canonicalResource(%q) = %q, want %q", tt.resource, got, tt.want)
+		}
+	}
+}
+
+func TestLookupOverride(t *testing.T) {
+	overrides := map[string]string{
+		"https://dev.azure.com":    "url",
+		"dev.azure.com":            "host",
+		"proxy.contoso.com":        "host only",
+		"http://proxy.contoso.com": "http url",
+	}
+	tests := []struct {
+		name      string
+		protocol  string
+		host      string
+		hostFirst bool
+		want      string
+		wantOK    bool
+	}{
+		{"url beats host", "https", "dev.azure.com", false, "url", true},
+		{"host-first", "https", "dev.azure.com", true, "host", true},
+		{"host form for any protocol", "https", "proxy.contoso.com", false, "host only", true},
+		{"protocol-specific url", "http", "proxy.contoso.com", false, "http url", true},
+		{"no match", "https", "example.com", false, "", false},
+	}
+	defer func() { hostFirstOverrides = false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostFirstOverrides = tt.hostFirst
+			got, ok := lookupOverride(overrides, tt.protocol, tt.host)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("lookupOverride(%s://%s) = %q, %t, want %q, %t", tt.protocol, tt.host, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestLookupOverridePaths(t *testing.T) {
+	overrides := map[string]string{
+		"https://dev.azure.com":                "url",
+		"dev.azure.com":                        "host",
+		"https://dev.azure.com/org":            "org",
+		"https://dev.azure.com/org/project":    "project",
+		"https://dev.azure.com/Org-Case/thing": "case kept",
+	}
+	tests := []struct {
+		name      string
+		path      string
+		hostFirst bool
+		want      string
+	}{
+		{"most specific path", "org/project/_git/repo.git", false, "project"},
+		{"organization path", "org/other/_git/repo", false, "org"},
+		{"path beats host-first", "org/x", true, "org"},
+		{"unknown path falls back", "elsewhere/repo", false, "url"},
+		{"path keeps case", "Org-Case/thing", false, "case kept"},
+		{"path case mismatch", "org-case/thing", false, "url"},
+	}
+	defer func() { requestPath, hostFirstOverrides = "", false }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requestPath, hostFirstOverrides = tt.path, tt.hostFirst
+			if got, _ := lookupOverride(overrides, "https", "dev.azure.com"); got != tt.want {
+				t.Errorf("lookupOverride(https://dev.azure.com/%s) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInputLongLine(t *testing.T) {
+	long := strings.Repeat("a", 100*1024)
+	data, arrays := parseInput(strings.NewReader("wwwauth[]=" + long + "\nhost=a\n"))
+	if data["host"] != "a" {
+		t.Errorf("host = %q after a long line, want %q", data["host"], "a")
+	}
+	if len(arrays["wwwauth"]) != 1 || arrays["wwwauth"][0] != long {
+		t.Errorf("long wwwauth[] value was truncated or dropped")
+	}
+}
+
+func TestLookupOverrideCase(t *testing.T) {
+	overrides := map[string]string{"https://dev.azure.com": "url"}
+	for _, req := range [][2]string{{"HTTPS", "Dev.Azure.COM"}, {"https", "DEV.AZURE.COM"}} {
+		if got, ok := lookupOverride(overrides, req[0], req[1]); got != "url" || !ok {
+			t.Errorf("lookupOverride(%s://%s) = %q, %t, want %q, true", req[0], req[1], got, ok, "url")
+		}
+	}
+}
+
+func TestAuthorityOverride(t *testing.T) {
+	setTestConfig(t,
+		"azureclicredentialhelper.https://dev.azure.com.authority", "Organizations",
+		"azureclicredentialhelper.https://tenant.example.com.authority", "organizations",
+		"azureclicredentialhelper.https://tenant.example.com.tenant", "contoso.onmicrosoft.com",
+		"azureclicredentialhelper.https://common.example.com.authority", "common",
+		"azureclicredentialhelper.https://bogus.example.com.authority", "consumers",
+	)
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"dev.azure.com", "organizations"},
+		{"tenant.example.com", "contoso.onmicrosoft.com"},
+		{"common.example.com", ""},
+		{"bogus.example.com", ""},
+		{"example.com", ""},
+	}
+	for _, tt := range tests {
+		if got := getTenantForHost("https", tt.host); got != tt.want {
+			t.Errorf("getTenantForHost(%s) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+// unusableCredential fails the test if anything asks it for a token.
+type unusableCredential struct{ t *testing.T }
+
+func (c unusableCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.t.Errorf("GetToken called for %v", opts.Scopes)
+	return azcore.AccessToken{}, errors.New("unusable credential")
+}
+
+func TestHandleGetOffline(t *testing.T) {
+	for _, cached := range []bool{true, false} {
+		t.Run(fmt.Sprintf("cached=%t", cached), func(t *testing.T) {
+			setTestConfig(t,
+				"azureclicredentialhelper.offlinecheck", "true",
+				"azureclicredentialhelper.cachedir", filepath.Join(t.TempDir(), "cache"),
+			)
+			// Nothing under .invalid resolves, so the offline probe fails
+			t.Setenv("AZURE_AUTHORITY_HOST", "https://login.offline.invalid")
+			setTestCredential(t, "", unusableCredential{t})
+			if cached {
+				storeCachedToken(getResourceForHost("https", "dev.azure.com"), "", "cached-token", time.Now().Add(time.Hour).Unix())
+			}
+
+			data := map[string]string{"protocol": "https", "host": "dev.azure.com"}
+			var err error
+			out := captureStdout(t, func() { err = handleGet(data, nil, acquireToken, nil) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached && !strings.Contains(out, "password=cached-token\n") {
+				t.Errorf("offline get printed %q, want the cached token", out)
+			}
+			if !cached && (out != "" || getResult != "skipped-offline") {
+				t.Errorf("offline get printed %q with result %q, want nothing and skipped-offline", out, getResult)
+			}
+		})
+	}
+}
+
+func TestAllowedURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string
+		host    string
+		path    string
+		want    bool
+	}{
+		{"host prefix, no path", "https://dev.azure.com", "dev.azure.com", "", true},
+		{"host prefix, any path", "https://dev.azure.com/", "dev.azure.com", "org/_git/repo", true},
+		{"host prefix, other host", "https://dev.azure.com", "other.example.com", "", false},
+		{"path prefix, under it", "https://dev.azure.com/org", "dev.azure.com", "org/project/_git/repo", true},
+		{"path prefix, exact", "https://dev.azure.com/org", "dev.azure.com", "org", true},
+		{"path prefix, sibling", "https://dev.azure.com/org", "dev.azure.com", "org2/project", false},
+		{"path prefix, no path sent", "https://dev.azure.com/org", "dev.azure.com", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, "azureclicredentialhelper.allowedurl", tt.allowed)
+			if got := isAllowedRequest("https", tt.host, tt.path); got != tt.want {
+				t.Errorf("isAllowedRequest(%s/%s) with allowedURL %s = %t, want %t", tt.host, tt.path, tt.allowed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigResetsAllowLists(t *testing.T) {
+	setTestConfig(t,
+		"azureclicredentialhelper.alloweddomain", "contoso.com",
+		"azureclicredentialhelper.allowedurl", "https://dev.azure.com/org",
+	)
+	loadConfig()
+	if len(allowedDomains) != 1 || len(allowedURLs) != 1 {
+		t.Errorf("after reloading, allowedDomains = %v, allowedURLs = %v, want one entry each", allowedDomains, allowedURLs)
+	}
+	setTestConfig(t)
+	if len(allowedURLs) != 0 || !slices.Equal(allowedDomains, defaultAllowedDomains) {
+		t.Errorf("with no config, allowedDomains = %v, allowedURLs = %v, want the defaults", allowedDomains, allowedURLs)
+	}
+}
+
+func TestLookupResourceOverridePrecedence(t *testing.T) {
+	const host = "git.team.contoso.com"
+	layers := map[string][]string{
+		"exact":    {"azureclicredentialhelper.https://git.team.contoso.com.resource", "https://exact"},
+		"parent":   {"azureclicredentialhelper.contoso.com.resource", "https://parent"},
+		"wildcard": {"azureclicredentialhelper.*.resource", "https://wildcard"},
+		"high":     {"azureclicredentialhelper.policyprecedence", "high"},
+	}
+	tests := []struct {
+		name     string
+		config   []string
+		policy   bool
+		manifest bool
+		want     string
+	}{
+		{"exact beats parent", []string{"exact", "parent", "wildcard"}, true, true, "https://exact"},
+		{"parent beats wildcard", []string{"parent", "wildcard"}, true, true, "https://parent"},
+		{"wildcard beats policy", []string{"wildcard"}, true, true, "https://wildcard"},
+		{"policy beats manifest", nil, true, true, "https://policy"},
+		{"manifest last", nil, false, true, "https://manifest"},
+		{"nothing", nil, false, false, ""},
+		{"high policy beats exact", []string{"high", "exact"}, true, true, "https://policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var kv []string
+			for _, layer := range tt.config {
+				kv = append(kv, layers[layer]...)
+			}
+			setTestConfig(t, kv...)
+			policyOnce.Do(func() {})
+			policyResources = map[string]string{}
+			if tt.policy {
+				policyResources[host] = "https://policy"
+			}
+			if tt.manifest {
+				manifestResources[host] = "https://manifest"
+			}
+			t.Cleanup(func() { policyResources = map[string]string{} })
+			got, _ := lookupResourceOverride("https", host)
+			if got != tt.want {
+				t.Errorf("lookupResourceOverride(%s) = %q, want %q", host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupResourceOverrideSkipsTLD(t *testing.T) {
+	setTestConfig(t, "azureclicredentialhelper.com.resource", "https://tld")
+	if got, ok := lookupResourceOverride("https", "contoso.com"); ok {
+		t.Errorf("a bare TLD override matched contoso.com: %q", got)
+	}
+}
+
+func TestHandleGetNoHost(t *testing.T) {
+	setTestConfig(t)
+	setTestCredential(t, "", unusableCredential{t})
+	data := map[string]string{"protocol": "https"}
+	var err error
+	out := captureStdout(t, func() { err = handleGet(data, nil, acquireToken, nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "" || getResult != "skipped-no-host" {
+		t.Errorf("get without a host printed %q with result %q, want nothing and skipped-no-host", out, getResult)
+	}
+}
+
+func TestRequestURL(t *testing.T) {
+	tests := []struct {
+		data map[string]string
+		want string
+	}{
+		{map[string]string{"protocol": "https", "host": "dev.azure.com"}, "https://dev.azure.com"},
+		{map[string]string{"protocol": "https", "host": "dev.azure.com", "path": "org/_git/repo"}, "https://dev.azure.com/org/_git/repo"},
+		{map[string]string{"protocol": "https", "host": "dev.azure.com", "path": "/org"}, "https://dev.azure.com/org"},
+		{map[string]string{"protocol": "http", "host": "tfs.example.com:8080", "path": "tfs/DefaultCollection"}, "http://tfs.example.com:8080/tfs/DefaultCollection"},
+		{map[string]string{"host": "dev.azure.com"}, ""},
+		{map[string]string{"protocol": "https"}, ""},
+	}
+	for _, tt := range tests {
+		if got := requestURL(tt.data); got != tt.want {
+			t.Errorf("requestURL(%v) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestHandleGetAllowedProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   []string
+		protocol string
+		handled  bool
+	}{
+		{"https by default", nil, "https", true},
+		{"http skipped by default", nil, "http", false},
+		{"protocol case ignored", nil, "HTTPS", true},
+		{"http configured", []string{"azureclicredentialhelper.allowedprotocol", "HTTP"}, "http", true},
+		{"configured list replaces the default", []string{"azureclicredentialhelper.allowedprotocol", "http"}, "https", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, append(tt.config, "azureclicredentialhelper.cachedir", t.TempDir())...)
+			setTestCredential(t, "", &stubCredential{})
+			data := map[string]string{"protocol": tt.protocol, "host": "dev.azure.com"}
+			var err error
+			out := captureStdout(t, func() { err = handleGet(data, nil, acquireToken, nil) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if handled := strings.Contains(out, "password=token\n"); handled != tt.handled {
+				t.Errorf("get for %s printed %q with result %q, want handled %t", tt.protocol, out, getResult, tt.handled)
+			}
+			if !tt.handled && getResult != "skipped-protocol" {
+				t.Errorf("result = %q, want skipped-protocol", getResult)
+			}
+		})
+	}
+}
+
+func TestParseWWWAuth(t *testing.T) {
+	const claims = "eyJhY2Nlc3NfdG9rZW4iOnsibmJmIjp7ImVzc2VudGlhbCI6dHJ1ZSwidmFsdWUiOiIxNzAwMDAwMDAwIn19fQ=="
+	tests := []struct {
+		name    string
+		entries []string
+		want    wwwAuthChallenge
+	}{
+		{
+			name:    "none",
+			entries: nil,
+		},
+		{
+			name:    "Basic realm",
+			entries: []string{`Basic realm="https://tfs.example.com/"`},
+			want:    wwwAuthChallenge{Realm: "https://tfs.example.com/"},
+		},
+		{
+			name: "Entra ID bearer challenge",
+			entries: []string{
+				`Bearer authorization_uri="https://login.microsoftonline.com/common", scope="499b84ac-1321-427f-aa17-267ca6975798/.default"`,
+			},
+			want: wwwAuthChallenge{
+				AuthorizationURI: "https://login.microsoftonline.com/common",
+				Scope:            "499b84ac-1321-427f-aa17-267ca6975798/.default",
+			},
+		},
+		{
+			name: "claims challenge",
+			entries: []string{
+				`Bearer realm="", authorization_uri="https://login.microsoftonline.com/common/oauth2/authorize", error="insufficient_claims", claims="` + claims + `"`,
+			},
+			want: wwwAuthChallenge{
+				AuthorizationURI: "https://login.microsoftonline.com/common/oauth2/authorize",
+				Claims:           claims,
+				Error:            "insufficient_claims",
+			},
+		},
+		{
+			name:    "rejected token",
+			entries: []string{`Bearer error="invalid_token", error_description="The access token expired"`},
+			want:    wwwAuthChallenge{Error: "invalid_token", ErrorDescription: "The access token expired"},
+		},
+		{
+			name:    "first challenge wins",
+			entries: []string{`Basic realm="first"`, `Bearer realm="second", error="invalid_token"`},
+			want:    wwwAuthChallenge{Realm: "first", Error: "invalid_token"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseWWWAuth(tt.entries); got != tt.want {
+				t.Errorf("parseWWWAuth = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupResourceTenant(t *testing.T) {
+	setTestConfig(t,
+		"azureclicredentialhelper.https://storage.azure.com/.resourcetenant", "tenant-r",
+		"azureclicredentialhelper.https://git.contoso.com.resource", "https://storage.azure.com",
+		"azureclicredentialhelper.https://git.contoso.com.tenant", "tenant-h",
+	)
+	tests := []struct {
+		resource string
+		want     string
+		wantOK   bool
+	}{
+		{"https://storage.azure.com", "tenant-r", true},
+		{"https://storage.azure.com/", "tenant-r", true},
+		{"https://storage.azure.com/.default", "tenant-r", true},
+		{"HTTPS://Storage.Azure.com", "tenant-r", true},
+		{"https://storage.azure.com/other", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := lookupResourceTenant(tt.resource); got != tt.want || ok != tt.wantOK {
+			t.Errorf("lookupResourceTenant(%q) = %q, %t, want %q, %t", tt.resource, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	// The resource's tenant wins over one configured for the host
+	if got := getTenantForHost("https", "git.contoso.com"); got != "tenant-r" {
+		t.Errorf("getTenantForHost = %q, want the resource's tenant", got)
+	}
+}
+
+func TestEncodePasswordBase64(t *testing.T) {
+	setTestConfig(t)
+	encodePassword = "base64"
+	defer func() { encodePassword = "" }()
+	const token = "eyJ0eXAiOiJKV1QifQ.eyJhdWQiOiJ4In0.sig+/=;\x00é"
+
+	out := captureStdout(t, func() { outputCredential(map[string]string{"username": "user", "password": token}) })
+	var encoded string
+	for _, line := range strings.Split(out, "\n") {
+		if value, ok := strings.CutPrefix(line, "password=base64:"); ok {
+			encoded = value
+		}
+	}
+	if encoded == "" {
+		t.Fatalf("output %q has no base64: password", out)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("password %q isn't valid base64: %v", encoded, err)
+	}
+	if string(decoded) != token {
+		t.Errorf("decoded password = %q, want %q", decoded, token)
+	}
+	if !strings.Contains(out, "username=user\n") {
+		t.Errorf("other fields were changed: %q", out)
+	}
+}
+
+func TestExpiryUnix(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresOn time.Time
+		want      int64
+	}{
+		{"zero time", time.Time{}, 0},
+		{"whole second", time.Unix(1700000000, 0), 1700000000},
+		{"sub-second rounds down", time.Unix(1700000000, 999999999), 1700000000},
+		{"other zone", time.Unix(1700000000, 500000000).In(time.FixedZone("UTC+5", 5*3600)), 1700000000},
+		{"before 1970", time.Unix(-10, 0), 0},
+	}
+	for _, tt := range tests {
+		if got := expiryUnix(tt.expiresOn); got != tt.want {
+			t.Errorf("%s: expiryUnix = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleGetEchoesRequestCase(t *testing.T) {
+	setTestConfig(t,
+		"azureclicredentialhelper.outputfields", "protocol,host,path,url,password",
+		"azureclicredentialhelper.cachedir", t.TempDir(),
+	)
+	setTestCredential(t, "", &stubCredential{})
+	data := map[string]string{"protocol": "HTTPS", "host": "Dev.Azure.COM", "path": "Org/_git/Repo"}
+	var err error
+	out := captureStdout(t, func() { err = handleGet(data, nil, acquireToken, nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "protocol=HTTPS\nhost=Dev.Azure.COM\npath=Org/_git/Repo\nurl=HTTPS://Dev.Azure.COM/Org/_git/Repo\npassword=token\n"
+	if out != want {
+		t.Errorf("get printed %q, want %q", out, want)
+	}
+}
+
+func TestHandleGetAuthTypeCapability(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       []string
+		capabilities []string
+		wantAuthType bool
+	}{
+		{"advertised", nil, []string{"authtype"}, true},
+		{"not advertised", nil, nil, false},
+		{"other capability", nil, []string{"state"}, false},
+		{"always", []string{"azureclicredentialhelper.emitauthtype", "always"}, nil, true},
+		{"never", []string{"azureclicredentialhelper.emitauthtype", "never"}, []string{"authtype"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, append(tt.config, "azureclicredentialhelper.cachedir", t.TempDir())...)
+			setTestCredential(t, "", &stubCredential{})
+			data := map[string]string{"protocol": "https", "host": "dev.azure.com"}
+			arrays := map[string][]string{"capability": tt.capabilities}
+			var err error
+			out := captureStdout(t, func() { err = handleGet(data, arrays, acquireToken, nil) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out, "password=token\n") {
+				t.Fatalf("get printed %q, want a token", out)
+			}
+			if got := strings.Contains(out, "authtype=bearer\n"); got != tt.wantAuthType {
+				t.Errorf("get printed %q, want authtype %t", out, tt.wantAuthType)
+			}
+		})
+	}
+}
+
+// emptyTokenCredential reports success with no token, as a broken az
+// extension can.
+type emptyTokenCredential struct{}
+
+func (emptyTokenCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestHandleGetEmptyToken(t *testing.T) {
+	lastError := filepath.Join(t.TempDir(), "last-error")
+	setTestConfig(t,
+		"azureclicredentialhelper.lasterror", lastError,
+		"azureclicredentialhelper.cachedir", t.TempDir(),
+	)
+	setTestCredential(t, "", emptyTokenCredential{})
+	data := map[string]string{"protocol": "https", "host": "dev.azure.com"}
+	var err error
+	out := captureStdout(t, func() { err = handleGet(data, nil, acquireToken, nil) })
+	if !errors.Is(err, errEmptyToken) {
+		t.Errorf("handleGet = %v, want errEmptyToken", err)
+	}
+	if out != "" {
+		t.Errorf("get printed %q, want nothing", out)
+	}
+	recorded, readErr := os.ReadFile(lastError)
+	if readErr != nil || !strings.Contains(string(recorded), errEmptyToken.Error()) {
+		t.Errorf("lastError = %q (%v), want the empty token error", recorded, readErr)
+	}
+}
+
+func TestGetUsernameForRequest(t *testing.T) {
+	setTestConfig(t,
+		"azureclicredentialhelper.https://dev.azure.com.basicusername", "pat-user",
+		"azureclicredentialhelper.https://dev.azure.com.username", "bearer-user",
+	)
+	tests := []struct {
+		host     string
+		authType string
+		want     string
+	}{
+		{"dev.azure.com", "", "pat-user"},
+		{"dev.azure.com", "Basic", "pat-user"},
+		{"dev.azure.com", "bearer", "bearer-user"},
+		{"other.visualstudio.com", "", "null"},
+	}
+	for _, tt := range tests {
+		if got := getUsernameForRequest("https", tt.host, tt.authType); got != tt.want {
+			t.Errorf("getUsernameForRequest(%s, %q) = %q, want %q", tt.host, tt.authType, got, tt.want)
+		}
+	}
+}
+
+func TestCleanConfigValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"tenant-a", "tenant-a"},
+		{"\uFEFFtenant-a", "tenant-a"},
+		{" \uFEFF tenant-a\t\r\n", "tenant-a"},
+		{"tenant-a\uFEFF", "tenant-a"},
+		{"a b", "a b"},
+		{"\uFEFF", ""},
+	}
+	for _, tt := range tests {
+		if got := cleanConfigValue(tt.value); got != tt.want {
+			t.Errorf("cleanConfigValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+
+	setTestConfig(t, "azureclicredentialhelper.https://dev.azure.com.tenant", "\uFEFFtenant-a ")
+	if got := getTenantForHost("https", "dev.azure.com"); got != "tenant-a" {
+		t.Errorf("loaded tenant = %q, want it cleaned", got)
+	}
+}
+
+func TestGetSummary(t *testing.T) {
+	tests := []struct {
+		name   string
+		config []string
+		cred   azcore.TokenCredential
+		input  string
+		want   string
+	}{
+		{"emitted", nil, &stubCredential{}, "protocol=https\nhost=dev.azure.com\n", "host=dev.azure.com result=emitted"},
+		{"failed", nil, &stubCredential{errs: []error{errors.New("AADSTS50076: MFA required")}}, "protocol=https\nhost=dev.azure.com\n", "host=dev.azure.com result=failed"},
+		{"no host", nil, unusableCredential{t}, "protocol=https\n", "host= result=skipped-no-host"},
+		{"protocol", nil, unusableCredential{t}, "protocol=http\nhost=dev.azure.com\n", "host=dev.azure.com result=skipped-protocol"},
+		{"not allowed", nil, unusableCredential{t}, "protocol=https\nhost=github.com\n", "host=github.com result=skipped-not-allowed"},
+		{
+			"existing", []string{"azureclicredentialhelper.overwriteexisting", "false"}, unusableCredential{t},
+			"protocol=https\nhost=dev.azure.com\npassword=pat\n", "host=dev.azure.com result=skipped-existing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, append(tt.config,
+				"azureclicredentialhelper.summary", "true",
+				"azureclicredentialhelper.cachedir", t.TempDir(),
+			)...)
+			setTestCredential(t, "", tt.cred)
+			var stderr string
+			withStdin(t, tt.input+"\n", func() {
+				stderr = captureStderr(t, func() {
+					captureStdout(t, func() { getCredential(nil, nil) })
+				})
+			})
+			want := "git-credential-azure-cli: " + tt.want + "\n"
+			if stderr != want {
+				t.Errorf("summary = %q, want %q", stderr, want)
+			}
+		})
+	}
+
+	// Off by default
+	setTestConfig(t, "azureclicredentialhelper.cachedir", t.TempDir())
+	setTestCredential(t, "", &stubCredential{})
+	var stderr string
+	withStdin(t, "protocol=https\nhost=dev.azure.com\n\n", func() {
+		stderr = captureStderr(t, func() {
+			captureStdout(t, func() { getCredential(nil, nil) })
+		})
+	})
+	if stderr != "" {
+		t.Errorf("summary printed without being enabled: %q", stderr)
+	}
+}
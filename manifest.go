@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the per-repository auth manifest, at the worktree root
+const manifestFileName = ".azure-auth"
+
+// Resource and tenant settings from the repository's .azure-auth manifest,
+// keyed like the git config overrides (URL or host). Only loaded when
+// azureCliCredentialHelper.repoManifest is enabled.
+var (
+	manifestResources map[string]string
+	manifestTenants   map[string]string
+)
+
+// repoManifest is the format of the .azure-auth file:
+//
+//	{
+//	  "hosts": {
+//	    "https://dev.azure.com": {"resource": "...", "tenant": "..."}
+//	  }
+//	}
+type repoManifest struct {
+	Hosts map[string]struct {
+		Resource string `json:"resource"`
+		Tenant   string `json:"tenant"`
+	} `json:"hosts"`
+}
+
+// loadRepoManifest reads .azure-auth from the root of the current worktree.
+// Like repository-local git config, it's untrusted input from whatever repo
+// was cloned, so it's only read when the user opts in from global config.
+func loadRepoManifest() {
+	manifestResources = make(map[string]string)
+	manifestTenants = make(map[string]string)
+
+	if !configBool(configKey("repomanifest"), false) {
+		return
+	}
+
+	out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		debugf(2, "Not in a git worktree, no %s manifest", manifestFileName)
+		return
+	}
+	path := filepath.Join(strings.TrimSpace(string(out)), manifestFileName)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			debugf(1, "Failed to read %s: %v", path, err)
+		}
+		return
+	}
+	var manifest repoManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		debugf(1, "Ignoring invalid %s: %v", path, err)
+		return
+	}
+
+	for key, settings := range manifest.Hosts {
+		if settings.Resource != "" {
+			manifestResources[overrideKey(key)] = cleanConfigValue(settings.Resource)
+			debugf(2, "Loaded resource from %s: %s -> %s", manifestFileName, key, settings.Resource)
+		}
+		if settings.Tenant != "" {
+			manifestTenants[overrideKey(key)] = cleanConfigValue(settings.Tenant)
+			debugf(2, "Loaded tenant from %s: %s -> %s", manifestFileName, key, settings.Tenant)
+		}
+	}
+	debugf(1, "Loaded %s", path)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Flags for migrate-netrc
+var (
+	migrateApply bool
+	migrateAll   bool
+)
+
+// netrcEntry is one machine entry in a .netrc file. Only the host and the
+// lines it spans are kept; credentials are never read into it.
+type netrcEntry struct {
+	host      string
+	firstLine int
+	lastLine  int
+	// shared is set when another entry starts on one of this entry's lines,
+	// so commenting the lines out would affect it too
+	shared bool
+}
+
+// parseNetrcEntries finds the machine entries in the lines of a .netrc
+// file. An entry runs from its "machine" token until the line before the
+// next entry (or "default") begins.
+func parseNetrcEntries(lines []string) []netrcEntry {
+	var entries []netrcEntry
+	var boundaries []int // lines where an entry or "default" starts
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		fields := strings.Fields(trimmed)
+		for j, field := range fields {
+			switch {
+			case field == "machine" && j+1 < len(fields):
+				entries = append(entries, netrcEntry{host: strings.ToLower(fields[j+1]), firstLine: i})
+				boundaries = append(boundaries, i)
+			case field == "default":
+				boundaries = append(boundaries, i)
+			}
+		}
+	}
+
+	for k := range entries {
+		e := &entries[k]
+		e.lastLine = len(lines) - 1
+		starts := 0
+		for _, b := range boundaries {
+			if b == e.firstLine {
+				starts++
+			} else if b > e.firstLine {
+				e.lastLine = b - 1
+				break
+			}
+		}
+		e.shared = starts > 1
+	}
+	return entries
+}
+
+// migrateNetrcCommand suggests (or with --apply, makes) the changes needed
+// to move hosts from ~/.netrc to this helper: adding them to allowedDomain
+// and commenting out their .netrc entries, which would otherwise take
+// precedence. Only hostnames are ever printed.
+func migrateNetrcCommand(cmd *cobra.Command, args []string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	netrcPath := filepath.Join(home, ".netrc")
+	content, err := os.ReadFile(netrcPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Printf("No .netrc file found at %s, nothing to migrate.\n", netrcPath)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	lines := strings.Split(string(content), "\n")
+	if migrateApply && strings.Contains(string(content), "macdef") {
+		fmt.Fprintf(os.Stderr, "Error: %s contains macro definitions; edit it by hand\n", netrcPath)
+		os.Exit(1)
+	}
+
+	loadConfig()
+	var candidates []netrcEntry
+	for _, e := range parseNetrcEntries(lines) {
+		if migrateAll || isAllowedHost(e.host, allowedDomains) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		fmt.Println("No .netrc entries to migrate.")
+		return
+	}
+
+	var newDomains []string
+	fmt.Printf("Found %d .netrc entries to migrate:\n", len(candidates))
+	for _, e := range candidates {
+		fmt.Printf("  %s (line %d)\n", e.host, e.firstLine+1)
+		if !isAllowedHost(e.host, allowedDomains) && !slices.Contains(newDomains, e.host) {
+			newDomains = append(newDomains, e.host)
+		}
+	}
+
+	// Configuring any allowedDomain replaces the defaults, so carry them over
+	if len(newDomains) > 0 && len(gitCfg.GetAll(configKey("alloweddomain"))) == 0 {
+		newDomains = append(slices.Clone(defaultAllowedDomains), newDomains...)
+	}
+
+	if !migrateApply {
+		fmt.Println("\nSuggested changes:")
+		for _, d := range newDomains {
+			fmt.Printf("  git config --global --add %s %q\n", configName("allowedDomain"), d)
+		}
+		for _, e := range candidates {
+			fmt.Printf("  Remove or comment out the .netrc entry for %s (line %d)\n", e.host, e.firstLine+1)
+		}
+		fmt.Println("\nRun with --apply to make these changes (.netrc is backed up first).")
+		return
+	}
+
+	for _, d := range newDomains {
+		if err := runGitConfig("config", "--global", "--add", configKey("alloweddomain"), d); err != nil {
+			fmt.Fprintf(os.Stderr, "Error adding allowed domain %s: %v\n", d, err)
+			os.Exit(1)
+		}
+		fmt.Printf("✓ Added allowed domain: %s\n", d)
+	}
+
+	backupPath := netrcPath + ".bak"
+	if err := os.WriteFile(backupPath, content, 0o600); err != nil {
+		fmt.Fprintf(os.Stderr, "Error backing up .netrc: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("✓ Backed up .netrc to %s\n", backupPath)
+
+	for _, e := range candidates {
+		if e.shared {
+			fmt.Fprintf(os.Stderr, "⚠️  Not commenting out %s: it shares a line with another entry; edit .netrc by hand\n", e.host)
+			continue
+		}
+		for i := e.firstLine; i <= e.lastLine && i < len(lines); i++ {
+			if trimmed := strings.TrimSpace(lines[i]); trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				lines[i] = "# " + lines[i]
+			}
+		}
+		fmt.Printf("✓ Commented out .netrc entry for %s\n", e.host)
+	}
+
+	mode := os.FileMode(0o600)
+	if fi, err := os.Stat(netrcPath); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.WriteFile(netrcPath, []byte(strings.Join(lines, "\n")), mode); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing .netrc: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a fetched policy is used before it's fetched again
+const defaultPolicyTTL = time.Hour
+
+// Resource and tenant settings from the central policy at
+// azureCliCredentialHelper.policyURL, keyed like the git config overrides
+// (URL, host or "*"). Loaded on first use, so requests for hosts we don't
+// handle never fetch it.
+var (
+	policyOnce      sync.Once
+	policyResources map[string]string
+	policyTenants   map[string]string
+)
+
+// policyTakesPrecedence reports whether the central policy overrides local
+// git config (azureCliCredentialHelper.policyPrecedence "high") rather than
+// only filling in what local config leaves unset ("low", the default).
+func policyTakesPrecedence() bool {
+	return strings.EqualFold(strings.TrimSpace(gitCfg.Get(configKey("policyprecedence"))), "high")
+}
+
+// lookupPolicy finds a policy setting for a request, falling back to the
+// policy's "*" entry.
+func lookupPolicy(settings func() map[string]string, protocol, host string) (string, bool) {
+	policyOnce.Do(loadPolicy)
+	overrides := settings()
+	if value, ok := lookupOverride(overrides, protocol, host); ok {
+		return value, true
+	}
+	value, ok := overrides["*"]
+	return value, ok
+}
+
+func lookupPolicyResource(protocol, host string) (string, bool) {
+	return lookupPolicy(func() map[string]string { return policyResources }, protocol, host)
+}
+
+func lookupPolicyTenant(protocol, host string) (string, bool) {
+	return lookupPolicy(func() map[string]string { return policyTenants }, protocol, host)
+}
+
+// loadPolicy loads the central policy, from the disk cache if it's fresher
+// than azureCliCredentialHelper.policyTTL and otherwise from policyURL. It
+// fails open: if the policy can't be fetched, a stale cached copy is used,
+// and failing that the helper carries on with local config alone.
+func loadPolicy() {
+	policyResources = make(map[string]string)
+	policyTenants = make(map[string]string)
+
+	policyURL := gitCfg.Get(configKey("policyurl"))
+	if policyURL == "" {
+		return
+	}
+	if !strings.HasPrefix(strings.ToLower(policyURL), "https://") {
+		debugf(1, "Ignoring policyURL %s: only https is supported", policyURL)
+		return
+	}
+
+	cachePath := policyCachePath(policyURL)
+	ttl := configDuration(configKey("policyttl"), defaultPolicyTTL)
+	var data []byte
+	if fi, err := os.Stat(cachePath); err == nil && time.Since(fi.ModTime()) < ttl {
+		data, _ = os.ReadFile(cachePath)
+		debugf(2, "Using cached policy from %s", cachePath)
+	}
+	if data == nil {
+		fetched, err := fetchPolicy(policyURL)
+		if err != nil {
+			debugf(1, "Failed to fetch policy from %s: %v", policyURL, err)
+			if data, _ = os.ReadFile(cachePath); data != nil {
+				debugf(1, "Using stale cached policy from %s", cachePath)
+			}
+		} else {
+			data = fetched
+			if cachePath != "" {
+				if err := os.WriteFile(cachePath, data, 0o600); err != nil {
+					debugf(1, "Failed to cache policy: %v", err)
+				}
+			}
+		}
+	}
+	if data == nil {
+		return
+	}
+
+	var policy repoManifest
+	if err := json.Unmarshal(data, &policy); err != nil {
+		debugf(1, "Ignoring invalid policy from %s: %v", policyURL, err)
+		return
+	}
+	for key, settings := range policy.Hosts {
+		if settings.Resource != "" {
+			policyResources[overrideKey(key)] = cleanConfigValue(settings.Resource)
+		}
+		if settings.Tenant != "" {
+			policyTenants[overrideKey(key)] = cleanConfigValue(settings.Tenant)
+		}
+	}
+	debugf(2, "Loaded policy for %d hosts from %s", len(policy.Hosts), policyURL)
+}
+
+// fetchPolicy downloads the policy document.
+func fetchPolicy(policyURL string) ([]byte, error) {
+	client, err := newHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(policyURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, errors.New("response is not valid JSON")
+	}
+	return data, nil
+}
+
+// policyCachePath returns where the policy from policyURL is cached, or ""
+// if there's no usable cache directory.
+func policyCachePath(policyURL string) string {
+	dir, err := cacheDir()
+	if err != nil {
+		debugf(1, "Policy cache unavailable: %v", err)
+		return ""
+	}
+	sum := sha256.Sum256([]byte(policyURL))
+	return filepath.Join(dir, "policy-"+hex.EncodeToString(sum[:8])+".json")
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// How long the optional reachability check waits for a TCP connection
+const reachabilityTimeout = 2 * time.Second
+
+// isHostReachable reports whether a TCP connection to the request's host
+// can be opened quickly. host may include a port; otherwise the protocol's
+// default port is used.
+func isHostReachable(protocol, host string) bool {
+	addr := host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "443"
+		if protocol == "http" {
+			port = "80"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, reachabilityTimeout)
+	if err != nil {
+		debugf(1, "Reachability check for %s failed: %v", addr, err)
+		return false
+	}
+	conn.Close()
+	debugf(2, "Reachability check for %s succeeded in %v", addr, time.Since(start).Round(time.Millisecond))
+	return true
+}
+
+// How long the offline fast path's DNS probe may take
+const offlineProbeTimeout = 300 * time.Millisecond
+
+// Entra ID authority used for the offline probe, unless AZURE_AUTHORITY_HOST
+// names another cloud's
+const defaultAuthorityHost = "login.microsoftonline.com"
+
+// isOffline reports whether the Entra ID authority's name can't be resolved
+// within offlineProbeTimeout. Online, the lookup is answered from the OS
+// resolver cache almost instantly; offline, it fails about as fast.
+func isOffline() bool {
+	authority := defaultAuthorityHost
+	if env := os.Getenv("AZURE_AUTHORITY_HOST"); env != "" {
+		if u, err := url.Parse(env); err == nil && u.Hostname() != "" {
+			authority = u.Hostname()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), offlineProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	if _, err := net.DefaultResolver.LookupHost(ctx, authority); err != nil {
+		debugf(1, "Offline check: can't resolve %s: %v", authority, err)
+		return true
+	}
+	debugf(2, "Offline check: resolved %s in %v", authority, time.Since(start).Round(time.Millisecond))
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Set in the environment of everything the helper runs (git, az), so a
+// misconfiguration that makes git call back into the helper from one of
+// those subprocesses is detected instead of recursing.
+const activeEnvVar = "AZURE_CLI_HELPER_ACTIVE"
+
+// Whether this process was started by another invocation of the helper
+var recursiveInvocation bool
+
+// markActive records whether we were invoked recursively, then marks the
+// environment for our own subprocesses. Called once at startup.
+func markActive() {
+	recursiveInvocation = os.Getenv(activeEnvVar) == "1"
+	os.Setenv(activeEnvVar, "1")
+}
+
+// isOwnExecutable reports whether path is this helper's executable, with
+// symlinks resolved.
+func isOwnExecutable(path, exePath string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	self, err := filepath.EvalSymlinks(exePath)
+	if err != nil {
+		self = exePath
+	}
+	return resolved == self
+}
+
+// cacheHelperIsSelf reports whether the "cache" credential helper git would
+// run resolves to this executable, e.g. because git-credential-cache was
+// replaced by a symlink to us. Registering it would make the helper call
+// itself.
+func cacheHelperIsSelf(exePath string) bool {
+	var candidates []string
+	if out, err := exec.Command("git", "--exec-path").Output(); err == nil {
+		candidates = append(candidates, filepath.Join(strings.TrimSpace(string(out)), "git-credential-cache"))
+	}
+	if path, err := exec.LookPath("git-credential-cache"); err == nil {
+		candidates = append(candidates, path)
+	}
+	for _, c := range candidates {
+		if isOwnExecutable(c, exePath) {
+			debugf(1, "Cache helper %s resolves to this executable", c)
+			return true
+		}
+	}
+	return false
+}
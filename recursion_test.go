@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMarkActive(t *testing.T) {
+	t.Setenv(activeEnvVar, "")
+	defer func() { recursiveInvocation = false }()
+
+	markActive()
+	if recursiveInvocation {
+		t.Error("first invocation was treated as recursive")
+	}
+	if got := os.Getenv(activeEnvVar); got != "1" {
+		t.Fatalf("%s = %q after markActive, want 1", activeEnvVar, got)
+	}
+	// A subprocess inherits the marker
+	markActive()
+	if !recursiveInvocation {
+		t.Error("invocation with the marker set wasn't treated as recursive")
+	}
+}
+
+func TestGetCredentialRecursive(t *testing.T) {
+	setTestConfig(t)
+	setTestCredential(t, "", unusableCredential{t})
+	recursiveInvocation = true
+	defer func() { recursiveInvocation = false }()
+
+	var out string
+	withStdin(t, "protocol=https\nhost=dev.azure.com\n\n", func() {
+		out = captureStdout(t, func() { getCredential(nil, nil) })
+	})
+	if out != "" {
+		t.Errorf("recursive get printed %q, want nothing", out)
+	}
+}
+
+func TestIsOwnExecutable(t *testing.T) {
+	dir := t.TempDir()
+	exe := filepath.Join(dir, "git-credential-azure-cli")
+	other := filepath.Join(dir, "git-credential-cache")
+	link := filepath.Join(dir, "link")
+	for _, path := range []string{exe, other} {
+		if err := os.WriteFile(path, nil, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(exe, link); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{exe, true},
+		{link, true},
+		{other, false},
+		{filepath.Join(dir, "missing"), false},
+	}
+	for _, tt := range tests {
+		if got := isOwnExecutable(tt.path, exe); got != tt.want {
+			t.Errorf("isOwnExecutable(%s) = %t, want %t", filepath.Base(tt.path), got, tt.want)
+		}
+	}
+}
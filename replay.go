@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Whether replay substitutes a fake token for real acquisition
+var replayFake bool
+
+// Whether requests are being replayed rather than made by git, so they
+// leave no audit records or lastError file behind
+var replaying bool
+
+// Blank lines (possibly with whitespace) separate requests in a replay file
+var requestSeparatorRe = regexp.MustCompile(`\r?\n[ \t]*\r?\n`)
+
+// replayCommand runs each credential request in a file through the same
+// handling as get, printing what the helper would output for each. With
+// --fake, no credential source is contacted.
+func replayCommand(cmd *cobra.Command, args []string) {
+	content, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	loadConfig()
+	replaying = true
+	defer func() { replaying = false }()
+	acquire := acquireToken
+	if replayFake {
+		acquire = fakeAcquireToken
+	}
+
+	var blocks []string
+	for _, block := range requestSeparatorRe.Split(string(content), -1) {
+		if strings.TrimSpace(block) != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	for i, block := range blocks {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("# request %d\n", i+1)
+		data, arrays := parseInput(strings.NewReader(block))
+		timer := newStageTimer()
+		if err := handleGet(data, arrays, acquire, timer); err != nil {
+			fmt.Printf("# error: %v\n", err)
+		}
+		timer.report()
+	}
+}
+
+// fakeAcquireToken stands in for acquireToken in replay --fake. It still
+// resolves the resource, so requests that couldn't get a token fail the
+// same way.
+func fakeAcquireToken(ctx context.Context, protocol, host string, wwwauth []string, timer *stageTimer) (string, int64, error) {
+	resource := getResourceForHost(protocol, host)
+	if resource == "" {
+		return "", 0, errors.New("no resource could be determined for the request")
+	}
+	return "fake-token-for-" + buildScope(resource, ".default"), time.Now().Add(time.Hour).Unix(), nil
+}
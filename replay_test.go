@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayLeavesNoTrace(t *testing.T) {
+	dir := t.TempDir()
+	lastError := filepath.Join(dir, "last-error")
+	setTestConfig(t, "azureclicredentialhelper.lasterror", lastError)
+	notFound := errors.New("AADSTS500011: The resource principal was not found")
+	setTestCredential(t, "", &stubCredential{errs: []error{notFound, notFound}})
+	requests := filepath.Join(dir, "requests")
+	if err := os.WriteFile(requests, []byte("protocol=https\nhost=dev.azure.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := captureStdout(t, func() { replayCommand(nil, []string{requests}) })
+	if !strings.Contains(out, "# error:") {
+		t.Fatalf("replay printed %q, want the request to fail", out)
+	}
+	if _, err := os.Stat(lastError); !os.IsNotExist(err) {
+		t.Errorf("replay wrote the lastError file (stat error %v)", err)
+	}
+	if replaying {
+		t.Error("replaying is still set after replay")
+	}
+
+	handleGet(map[string]string{"protocol": "https", "host": "dev.azure.com"}, nil, acquireToken, nil)
+	if _, err := os.Stat(lastError); err != nil {
+		t.Errorf("a real get didn't write the lastError file: %v", err)
+	}
+}
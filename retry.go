@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// Default time budgets for acquiring a token, including retries. The
+// interactive one applies when a user is at a terminal, since az may be
+// waiting on them to finish MFA in a browser.
+const (
+	defaultTimeout            = 30 * time.Second
+	defaultInteractiveTimeout = 120 * time.Second
+)
+
+// acquisitionTimeout returns the time budget for acquiring a token,
+// configured via azureCliCredentialHelper.timeout and interactiveTimeout.
+func acquisitionTimeout() time.Duration {
+	if canPromptUser() {
+		return configDuration(configKey("interactivetimeout"), defaultInteractiveTimeout)
+	}
+	return configDuration(configKey("timeout"), defaultTimeout)
+}
+
+// Retry tuning for transient failures. Throttling uses the server's
+// Retry-After instead of this backoff.
+const (
+	maxAttempts          = 3
+	initialBackoff       = 1 * time.Second
+	defaultThrottleDelay = 5 * time.Second
+)
+
+// Number of throttled responses seen by this process, for the stress command
+var throttleEvents atomic.Int64
+
+// errorClass categorizes a token acquisition failure for the retry loop.
+type errorClass int
+
+const (
+	// errorClassAuth is a hard failure (not logged in, bad scope, consent
+	// required). Retrying won't help, so we fail immediately.
+	errorClassAuth errorClass = iota
+	// errorClassTransient is a network blip or similar that is likely to
+	// succeed on a later attempt.
+	errorClassTransient
+	// errorClassThrottled means AAD answered with HTTP 429.
+	errorClassThrottled
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case errorClassTransient:
+		return "transient"
+	case errorClassThrottled:
+		return "throttled"
+	default:
+		return "auth"
+	}
+}
+
+// Substrings of error messages that indicate a transient failure. The Azure
+// CLI path only gives us az's stderr, so message matching is all we have.
+var transientErrorPatterns = []string{
+	"connection reset",
+	"connection refused",
+	"connection aborted",
+	"i/o timeout",
+	"temporary failure in name resolution",
+	"tls handshake timeout",
+	"max retries exceeded",
+	"503 service unavailable",
+	"502 bad gateway",
+	"504 gateway timeout",
+}
+
+// Substrings of error messages that indicate throttling: HTTP 429 in the
+// forms az and MSAL report it, and the AADSTS codes Entra ID uses for
+// request throttling. A bare "429" would also match timestamps, request IDs
+// and the like.
+var throttledErrorPatterns = []string{
+	"too many requests",
+	"status code 429",
+	"status code: 429",
+	"statuscode: 429",
+	"response 429",
+	"aadsts50196",
+	"aadsts90055",
+}
+
+// User-configured regexes (azureCliCredentialHelper.transientErrorPatterns)
+// that mark an error as transient, in addition to transientErrorPatterns
+var customTransientPatterns []*regexp.Regexp
+
+// loadTransientErrorPatterns compiles the configured transient error
+// patterns, case-insensitively. Invalid patterns are skipped, and patterns
+// that match everything (like ".*") are kept but warned about, since they
+// make every failure retryable.
+func loadTransientErrorPatterns() {
+	customTransientPatterns = nil
+	for _, pattern := range gitCfg.GetAll(configKey("transienterrorpatterns")) {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			debugf(1, "Ignoring invalid transientErrorPatterns entry %q: %v", pattern, err)
+			continue
+		}
+		if re.MatchString("") {
+			debugf(1, "Warning: transientErrorPatterns entry %q matches any error, so every failure will be retried", pattern)
+		}
+		customTransientPatterns = append(customTransientPatterns, re)
+	}
+}
+
+// classifyError decides how the retry loop should treat err. For throttling
+// it also returns how long the server asked us to wait (zero if unknown).
+func classifyError(err error) (errorClass, time.Duration) {
+	var authErr *azidentity.AuthenticationFailedError
+	if errors.As(err, &authErr) && authErr.RawResponse != nil {
+		switch status := authErr.RawResponse.StatusCode; {
+		case status == http.StatusTooManyRequests:
+			return errorClassThrottled, parseRetryAfter(authErr.RawResponse.Header.Get("Retry-After"))
+		case status >= 500:
+			return errorClassTransient, 0
+		}
+	}
+
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusTooManyRequests {
+		var retryAfter time.Duration
+		if respErr.RawResponse != nil {
+			retryAfter = parseRetryAfter(respErr.RawResponse.Header.Get("Retry-After"))
+		}
+		return errorClassThrottled, retryAfter
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range throttledErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return errorClassThrottled, 0
+		}
+	}
+	for _, pattern := range transientErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return errorClassTransient, 0
+		}
+	}
+	for _, re := range customTransientPatterns {
+		if re.MatchString(msg) {
+			debugf(2, "Error matched transientErrorPatterns entry %q", strings.TrimPrefix(re.String(), "(?i)"))
+			return errorClassTransient, 0
+		}
+	}
+	return errorClassAuth, 0
+}
+
+// parseRetryAfter parses a Retry-After header value, which may be either a
+// number of seconds or an HTTP date. It returns zero if the value is empty
+// or unparseable.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// getAccessTokenWithRetry wraps getAccessToken with retries for transient
+// errors (exponential backoff) and throttling (honoring Retry-After). Hard
+// auth failures are returned immediately. All waiting is bounded by the
+// context deadline.
+func getAccessTokenWithRetry(ctx context.Context, cred azcore.TokenCredential, resource string, req tokenRequest) (string, int64, error) {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		token, expiry, err := getAccessToken(ctx, cred, resource, req)
+		if err == nil {
+			return token, expiry, nil
+		}
+
+		class, delay := classifyError(err)
+		if class == errorClassThrottled {
+			throttleEvents.Add(1)
+		}
+		if class == errorClassAuth || attempt >= maxAttempts {
+			return "", 0, err
+		}
+		if class == errorClassThrottled {
+			if delay == 0 {
+				delay = defaultThrottleDelay
+			}
+		} else {
+			delay = backoff
+			backoff *= 2
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			debugf(1, "Not retrying %s error: wait of %v exceeds remaining time", class, delay)
+			return "", 0, err
+		}
+		debugf(1, "Attempt %d failed with %s error, retrying in %v", attempt, class, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", 0, err
+		}
+	}
+}
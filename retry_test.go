@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// stubCredential returns each of errs in turn, then a token.
+type stubCredential struct {
+	errs  []error
+	calls int
+}
+
+func (c *stubCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls++
+	if c.calls <= len(c.errs) {
+		return azcore.AccessToken{}, c.errs[c.calls-1]
+	}
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Unix(2000000000, 0)}, nil
+}
+
+// throttledError is a 429 response asking us to wait retryAfter.
+func throttledError(retryAfter string) error {
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set("Retry-After", retryAfter)
+	return &azcore.ResponseError{StatusCode: http.StatusTooManyRequests, RawResponse: resp}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err       error
+		want      errorClass
+		wantDelay time.Duration
+	}{
+		{throttledError("7"), errorClassThrottled, 7 * time.Second},
+		{errors.New("ERROR: 429 Too Many Requests"), errorClassThrottled, 0},
+		{errors.New("request failed with status code 429"), errorClassThrottled, 0},
+		{errors.New("StatusCode: 429, throttled"), errorClassThrottled, 0},
+		{errors.New("AADSTS50196: The server terminated an operation because it encountered a client request loop"), errorClassThrottled, 0},
+		{errors.New("AADSTS90055: TenantThrottlingError"), errorClassThrottled, 0},
+		{errors.New("AADSTS700082: refresh token expired. Trace ID: 4291ab34 Timestamp: 2024-04-29 10:14:29Z"), errorClassAuth, 0},
+		{errors.New("subscription 1429a3f0-0000-0000-0000-000000000000 not found"), errorClassAuth, 0},
+		{errors.New("dial tcp: connection refused"), errorClassTransient, 0},
+		{errors.New("502 Bad Gateway"), errorClassTransient, 0},
+		{errors.New("Please run 'az login' to setup account."), errorClassAuth, 0},
+	}
+	for _, tt := range tests {
+		class, delay := classifyError(tt.err)
+		if class != tt.want || delay != tt.wantDelay {
+			t.Errorf("classifyError(%q) = %v, %v, want %v, %v", tt.err, class, delay, tt.want, tt.wantDelay)
+		}
+	}
+}
+
+func TestGetAccessTokenWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", nil, 1, false},
+		{"throttled then success", []error{throttledError("1")}, 2, false},
+		{"auth failure is not retried", []error{errors.New("AADSTS50076: MFA required")}, 1, true},
+		{"gives up after maxAttempts", []error{throttledError("1"), throttledError("1"), throttledError("1")}, maxAttempts, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred := &stubCredential{errs: tt.errs}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			token, expiry, err := getAccessTokenWithRetry(ctx, cred, "https://example.com", tokenRequest{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %t", err, tt.wantErr)
+			}
+			if cred.calls != tt.wantCalls {
+				t.Errorf("GetToken called %d times, want %d", cred.calls, tt.wantCalls)
+			}
+			if !tt.wantErr && (token != "token" || expiry != 2000000000) {
+				t.Errorf("got %q, %d", token, expiry)
+			}
+		})
+	}
+}
+
+func TestRealmFallbackRetries(t *testing.T) {
+	setTestConfig(t, "azureclicredentialhelper.cachedir", t.TempDir())
+	// The primary resource fails outright, then the realm is throttled once
+	notFound := errors.New("AADSTS500011: The resource principal was not found")
+	cred := &stubCredential{errs: []error{notFound, throttledError("1")}}
+	setTestCredential(t, "", cred)
+	wwwauth := []string{`Bearer realm="https://realm.example.com"`}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	token, _, err := acquireToken(ctx, "https", "git.example.com", wwwauth, nil)
+	if err != nil || token != "token" {
+		t.Fatalf("acquireToken = %q, %v, want the realm token after a retry", token, err)
+	}
+	if cred.calls != 3 {
+		t.Errorf("GetToken called %d times, want 3", cred.calls)
+	}
+}
+
+func TestTransientErrorPatterns(t *testing.T) {
+	setTestConfig(t,
+		"azureclicredentialhelper.transienterrorpatterns", `proxy error \d+`,
+		"azureclicredentialhelper.transienterrorpatterns", "([unclosed",
+		"azureclicredentialhelper.transienterrorpatterns", ".*",
+	)
+	var log bytes.Buffer
+	defer func(out io.Writer, level int) { logOutput, verbosity = out, level }(logOutput, verbosity)
+	logOutput, verbosity = &log, 1
+	loadTransientErrorPatterns()
+	defer func() { customTransientPatterns = nil }()
+
+	if len(customTransientPatterns) != 2 {
+		t.Fatalf("loaded %d patterns, want 2 (the invalid one skipped)", len(customTransientPatterns))
+	}
+	if !strings.Contains(log.String(), `Ignoring invalid transientErrorPatterns entry "([unclosed"`) {
+		t.Errorf("invalid pattern wasn't reported: %q", log.String())
+	}
+	if !strings.Contains(log.String(), `entry ".*" matches any error`) {
+		t.Errorf("match-everything pattern wasn't warned about: %q", log.String())
+	}
+	if class, _ := classifyError(errors.New("upstream Proxy Error 502 from gateway")); class != errorClassTransient {
+		t.Errorf("custom pattern didn't classify the error as transient: %v", class)
+	}
+
+	customTransientPatterns = customTransientPatterns[:1]
+	if class, _ := classifyError(errors.New("AADSTS50076: MFA required")); class != errorClassAuth {
+		t.Errorf("unmatched error classified as %v, want auth", class)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Number of parallel acquisitions for the stress command
+var stressCount int
+
+// stressCommand fires parallel token acquisitions for one host through the
+// same path get uses, to reproduce throttling from parallel fetches.
+func stressCommand(cmd *cobra.Command, args []string) {
+	u, err := url.Parse(args[0])
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error: invalid URL %q\n", args[0])
+		os.Exit(1)
+	}
+	if stressCount < 1 {
+		fmt.Fprintf(os.Stderr, "Error: --count must be at least 1\n")
+		os.Exit(1)
+	}
+
+	loadConfig()
+	if !isAllowedRequest(u.Scheme, u.Host, u.Path) {
+		fmt.Fprintf(os.Stderr, "Error: %s is not in the allowed domains or URLs\n", u.Host)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Running %d parallel token acquisitions for %s://%s\n", stressCount, u.Scheme, u.Host)
+	if tokenCacheEnabled() {
+		fmt.Println("The token cache is on, as for git; use --no-cache to reach the token endpoint every time")
+	}
+
+	latencies := make([]time.Duration, stressCount)
+	errs := make([]error, stressCount)
+	var wg sync.WaitGroup
+	for i := range stressCount {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), acquisitionTimeout())
+			defer cancel()
+			start := time.Now()
+			_, _, errs[i] = acquireToken(ctx, u.Scheme, u.Host, nil, nil)
+			latencies[i] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	failures := 0
+	for _, err := range errs {
+		if err != nil {
+			failures++
+			debugf(1, "Acquisition failed: %v", err)
+		}
+	}
+	slices.Sort(latencies)
+	percentile := func(p int) time.Duration {
+		return latencies[(len(latencies)-1)*p/100].Round(time.Millisecond)
+	}
+
+	fmt.Printf("Succeeded: %d\n", stressCount-failures)
+	fmt.Printf("Failed:    %d\n", failures)
+	fmt.Printf("Throttled responses: %d\n", throttleEvents.Load())
+	fmt.Printf("Latency p50=%v p90=%v p99=%v max=%v\n", percentile(50), percentile(90), percentile(99), percentile(100))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Substrings of az errors that mean it couldn't settle on a subscription,
+// which a token doesn't actually need
+var subscriptionErrorPatterns = []string{
+	"az account set",
+	"no subscription found",
+	"subscription not found",
+}
+
+// isSubscriptionError reports whether err is az failing over subscription
+// selection rather than authentication.
+func isSubscriptionError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, pattern := range subscriptionErrorPatterns {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstSubscription asks az for the first enabled subscription it knows
+// about, for azureCliCredentialHelper.autoSelectSubscription.
+func firstSubscription(ctx context.Context, tenant string) (string, error) {
+	out, err := azCommand(ctx, "account", "list", "-o", "json").Output()
+	if err != nil {
+		return "", err
+	}
+	return pickSubscription(out, tenant)
+}
+
+// pickSubscription returns the first enabled subscription in az account
+// list's JSON output, in tenant if one is given (by ID or default domain).
+// Filtering here rather than in a --query keeps the tenant, which comes
+// from config, out of a JMESPath expression.
+func pickSubscription(accounts []byte, tenant string) (string, error) {
+	var subs []struct {
+		ID                  string `json:"id"`
+		State               string `json:"state"`
+		TenantID            string `json:"tenantId"`
+		TenantDefaultDomain string `json:"tenantDefaultDomain"`
+	}
+	if err := json.Unmarshal(accounts, &subs); err != nil {
+		return "", fmt.Errorf("failed to parse az account list output: %w", err)
+	}
+	for _, sub := range subs {
+		if sub.State != "Enabled" || sub.ID == "" {
+			continue
+		}
+		if tenant == "" || strings.EqualFold(sub.TenantID, tenant) || strings.EqualFold(sub.TenantDefaultDomain, tenant) {
+			return sub.ID, nil
+		}
+	}
+	return "", errors.New("az account list returned no enabled subscriptions")
+}
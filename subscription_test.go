@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestPickSubscription(t *testing.T) {
+	accounts := []byte(`[
+		{"id": "sub-disabled", "state": "Disabled", "tenantId": "11111111-1111-1111-1111-111111111111", "tenantDefaultDomain": "contoso.onmicrosoft.com"},
+		{"id": "sub-contoso", "state": "Enabled", "tenantId": "11111111-1111-1111-1111-111111111111", "tenantDefaultDomain": "contoso.onmicrosoft.com"},
+		{"id": "sub-fabrikam", "state": "Enabled", "tenantId": "22222222-2222-2222-2222-222222222222", "tenantDefaultDomain": "fabrikam.onmicrosoft.com"}
+	]`)
+	tests := []struct {
+		tenant  string
+		want    string
+		wantErr bool
+	}{
+		{"", "sub-contoso", false},
+		{"22222222-2222-2222-2222-222222222222", "sub-fabrikam", false},
+		{"Fabrikam.onmicrosoft.com", "sub-fabrikam", false},
+		{"other.onmicrosoft.com", "", true},
+		{"x' || tenantId!='", "", true},
+	}
+	for _, tt := range tests {
+		got, err := pickSubscription(accounts, tt.tenant)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("pickSubscription(%q) = %q, %v, want %q (error %t)", tt.tenant, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if _, err := pickSubscription([]byte("not json"), ""); err == nil {
+		t.Error("pickSubscription accepted output that isn't JSON")
+	}
+}
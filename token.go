@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Whether the token command only validates acquisition instead of printing
+// the token
+var tokenCheck bool
+
+// tokenCommand acquires a token for a URL through the same resolution path
+// get uses and prints it, or with --check, prints only a summary so it's safe
+// to run in logged CI steps.
+func tokenCommand(cmd *cobra.Command, args []string) {
+	u, err := url.Parse(args[0])
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error: invalid URL %q\n", args[0])
+		os.Exit(1)
+	}
+
+	timer := newStageTimer()
+	loadConfig()
+	timer.mark("config load")
+	requestPath = u.Path
+	if !isAllowedRequest(u.Scheme, u.Host, u.Path) {
+		fmt.Fprintf(os.Stderr, "Error: %s is not in the allowed domains or URLs\n", u.Host)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), acquisitionTimeout())
+	defer cancel()
+	accessToken, expiryUTC, err := acquireToken(ctx, u.Scheme, u.Host, nil, timer)
+	timer.report()
+	if err == nil && accessToken == "" {
+		err = errEmptyToken
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to get token for %s: %v\n", u.Host, err)
+		if guidance := loginGuidance(err); guidance != "" {
+			fmt.Fprintln(os.Stderr, guidance)
+		}
+		os.Exit(1)
+	}
+
+	if !tokenCheck {
+		fmt.Println(accessToken)
+		return
+	}
+
+	tenant := getTenantForHost(u.Scheme, u.Host)
+	if tenant == "" {
+		tenant = "default"
+	}
+	expires := "unknown"
+	if expiryUTC > 0 {
+		expires = time.Unix(expiryUTC, 0).UTC().Format(time.RFC3339)
+	}
+	fmt.Printf("OK scope=%s tenant=%s expires=%s\n", buildScope(getResourceForHost(u.Scheme, u.Host), ".default"), tenant, expires)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Token cache files, under the user cache directory. The key encrypts the
+// cache so tokens don't sit in plaintext in backups or search indexes;
+// against someone who can read both files as the user, the 0600
+// permissions are the real protection.
+const (
+	tokenCacheFileName = "tokens.json"
+	tokenCacheKeyName  = "tokens.key"
+	tokenCacheLockName = "tokens.lock"
+)
+
+// Cached tokens are refetched this long before they expire, so git never
+// gets a token that runs out mid-operation
+const defaultTokenCacheSkew = 5 * time.Minute
+
+// When the token endpoint fails transiently or throttles us, a cached token
+// inside the refresh window is served instead, as long as it's valid for at
+// least this long
+const fallbackTokenSkew = time.Minute
+
+// How long to wait for another process's cache update, and when a lock file
+// is old enough to have been left behind by a crashed one
+const (
+	tokenCacheLockWait  = 2 * time.Second
+	tokenCacheStaleLock = 10 * time.Second
+)
+
+// Whether to skip the token cache regardless of config (stress --no-cache)
+var bypassTokenCache bool
+
+// cachedToken is one token cache entry.
+type cachedToken struct {
+	Token     string `json:"token"`
+	ExpiresOn int64  `json:"expiresOn"`
+}
+
+// tokenCacheEnabled reports whether tokens are cached on disk
+// (azureCliCredentialHelper.cacheTokens, on by default).
+func tokenCacheEnabled() bool {
+	return !bypassTokenCache && configBool(configKey("cachetokens"), true)
+}
+
+// cacheDir returns the directory for everything the helper caches (tokens
+// and the fetched policy), creating it if needed: AZURE_CLI_HELPER_CACHE_DIR,
+// then azureCliCredentialHelper.cacheDir, then the helper's directory under
+// the user cache directory. A leading ~ is expanded.
+func cacheDir() (string, error) {
+	dir := os.Getenv("AZURE_CLI_HELPER_CACHE_DIR")
+	if dir == "" {
+		dir = gitCfg.Get(configKey("cachedir"))
+	}
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(base, "git-credential-azure-cli")
+	}
+	dir, err := expandHome(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// expandHome replaces a leading ~ in path with the home directory. git
+// doesn't expand it for us outside of pathname-typed settings.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~"+string(filepath.Separator)) {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// tokenCacheKey identifies a cached token by scope and tenant, and by the
+// configured credential source so switching sources doesn't serve a token
+// minted by the old one.
+func tokenCacheKey(resource, tenant string) string {
+	source := gitCfg.Get(configKey("credentialtype")) + "|" + gitCfg.Get(configKey("clientid")) + "|" + gitCfg.Get(configKey("managedidentityclientid")) + "|" + gitCfg.Get(configKey("certificatepath"))
+	return tokenCacheKeyPrefix(resource, tenant) + source
+}
+
+// tokenCacheKeyPrefix is the part of the cache key shared by every
+// credential source's token for resource and tenant.
+func tokenCacheKeyPrefix(resource, tenant string) string {
+	if tenant == "" {
+		tenant = "default"
+	}
+	return buildScope(resource, ".default") + " " + tenant + " "
+}
+
+// lookupCachedToken returns a cached token for resource and tenant that's
+// valid for longer than azureCliCredentialHelper.tokenCacheSkew.
+func lookupCachedToken(resource, tenant string) (string, int64, bool) {
+	return lookupCachedTokenValidFor(resource, tenant, configDuration(configKey("tokencacheskew"), defaultTokenCacheSkew))
+}
+
+// lookupCachedTokenValidFor returns a cached token for resource and tenant
+// that's valid for longer than skew.
+func lookupCachedTokenValidFor(resource, tenant string, skew time.Duration) (string, int64, bool) {
+	dir, err := cacheDir()
+	if err != nil {
+		debugf(1, "Token cache unavailable: %v", err)
+		return "", 0, false
+	}
+	entries, err := readTokenCache(dir)
+	if err != nil {
+		debugf(1, "Ignoring unreadable token cache: %v", err)
+		return "", 0, false
+	}
+	entry, ok := entries[tokenCacheKey(resource, tenant)]
+	if !ok {
+		debugf(2, "Token cache miss")
+		return "", 0, false
+	}
+	if time.Until(time.Unix(entry.ExpiresOn, 0)) <= skew {
+		debugf(2, "Cached token expires within %v, refreshing", skew)
+		return "", 0, false
+	}
+	return entry.Token, entry.ExpiresOn, true
+}
+
+// storeCachedToken saves a token for resource and tenant. Tokens without an
+// expiry aren't cached, since we couldn't tell when to stop serving them.
+func storeCachedToken(resource, tenant, token string, expiresOn int64) {
+	if expiresOn <= 0 {
+		return
+	}
+	updateTokenCache(func(entries map[string]cachedToken) {
+		entries[tokenCacheKey(resource, tenant)] = cachedToken{Token: token, ExpiresOn: expiresOn}
+	})
+}
+
+// eraseCachedToken drops the cached token for resource and tenant, after git
+// reports that the server rejected it.
+func eraseCachedToken(resource, tenant string) {
+	updateTokenCache(func(entries map[string]cachedToken) {
+		delete(entries, tokenCacheKey(resource, tenant))
+	})
+}
+
+// clearTokenCache deletes every cached token. The key is kept, so a process
+// that read it before the clear can still write a readable cache.
+func clearTokenCache(dir string) error {
+	unlock, err := lockTokenCache(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(filepath.Join(dir, tokenCacheFileName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// clearCachedTokens deletes the cached tokens for resource and tenant from
+// every credential source, returning how many were removed.
+func clearCachedTokens(dir, resource, tenant string) (int, error) {
+	unlock, err := lockTokenCache(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	entries, err := readTokenCache(dir)
+	if err != nil {
+		return 0, err
+	}
+	prefix := tokenCacheKeyPrefix(resource, tenant)
+	removed := 0
+	for key := range entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(entries, key)
+			removed++
+		}
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, writeTokenCache(dir, entries)
+}
+
+// updateTokenCache applies update to the cache under the lock, dropping
+// expired entries along the way. Failures are logged, never returned: the
+// cache is an optimization and must not break git.
+func updateTokenCache(update func(map[string]cachedToken)) {
+	dir, err := cacheDir()
+	if err != nil {
+		debugf(1, "Token cache unavailable: %v", err)
+		return
+	}
+	unlock, err := lockTokenCache(dir)
+	if err != nil {
+		debugf(1, "Not updating token cache: %v", err)
+		return
+	}
+	defer unlock()
+
+	entries, err := readTokenCache(dir)
+	if err != nil {
+		debugf(1, "Replacing unreadable token cache: %v", err)
+		entries = make(map[string]cachedToken)
+	}
+	update(entries)
+	now := time.Now().Unix()
+	for key, entry := range entries {
+		if entry.ExpiresOn <= now {
+			delete(entries, key)
+		}
+	}
+	if err := writeTokenCache(dir, entries); err != nil {
+		debugf(1, "Failed to write token cache: %v", err)
+	}
+}
+
+// lockTokenCache takes the cache's lock file, so parallel git processes
+// don't lose each other's updates. Readers don't need it: the cache is
+// replaced atomically.
+func lockTokenCache(dir string) (func(), error) {
+	path := filepath.Join(dir, tokenCacheLockName)
+	deadline := time.Now().Add(tokenCacheLockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if fi, statErr := os.Stat(path); statErr == nil && time.Since(fi.ModTime()) > tokenCacheStaleLock {
+			debugf(1, "Removing stale token cache lock %s", path)
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s", path)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// readTokenCache decrypts and parses the cache. A missing cache is empty.
+func readTokenCache(dir string) (map[string]cachedToken, error) {
+	entries := make(map[string]cachedToken)
+	data, err := os.ReadFile(filepath.Join(dir, tokenCacheFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := tokenCacheCipher(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("token cache is truncated")
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token cache: %w", err)
+	}
+	if err := json.Unmarshal(plain, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// writeTokenCache encrypts and writes the cache, replacing the old file
+// atomically.
+func writeTokenCache(dir string, entries map[string]cachedToken) error {
+	plain, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	aead, err := tokenCacheCipher(dir)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, tokenCacheFileName+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(aead.Seal(nonce, nonce, plain, nil)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, tokenCacheFileName))
+}
+
+// tokenCacheCipher returns the AES-GCM cipher for the cache, generating its
+// key on first use.
+func tokenCacheCipher(dir string) (cipher.AEAD, error) {
+	path := filepath.Join(dir, tokenCacheKeyName)
+	key, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err = createTokenCacheKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token cache key %s: %w", path, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// createTokenCacheKey generates and saves a new cache key. If another
+// process created one first, that one is used instead.
+func createTokenCacheKey(path string) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		return os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+// cacheClearCommand deletes every cached token, e.g. after switching
+// accounts with az login. Given a host (or URL), it deletes only the tokens
+// for that host's resource and tenant.
+func cacheClearCommand(cmd *cobra.Command, args []string) {
+	loadConfig()
+	dir, err := cacheDir()
+	if err == nil && len(args) == 0 {
+		err = clearTokenCache(dir)
+		if err == nil {
+			fmt.Printf("Cleared token cache in %s\n", dir)
+			return
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to clear token cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	protocol, host := "https", args[0]
+	if strings.Contains(host, "://") {
+		u, parseErr := url.Parse(host)
+		if parseErr != nil || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "Error: invalid URL %q\n", args[0])
+			os.Exit(1)
+		}
+		protocol, host, requestPath = u.Scheme, u.Host, u.Path
+	}
+	resource := getResourceForHost(protocol, host)
+	if resource == "" {
+		fmt.Fprintf(os.Stderr, "Error: no resource could be determined for %s\n", host)
+		os.Exit(1)
+	}
+	tenant := getTenantForHost(protocol, host)
+	removed, err := clearCachedTokens(dir, resource, tenant)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to clear cached tokens for %s: %v\n", host, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Cleared %d cached token(s) for %s (%s)\n", removed, host, buildScope(resource, ".default"))
+}
+
+// cacheListCommand prints the scope, tenant and expiry of each cached
+// token. Tokens are never printed.
+func cacheListCommand(cmd *cobra.Command, args []string) {
+	loadConfig()
+	dir, err := cacheDir()
+	var entries map[string]cachedToken
+	if err == nil {
+		entries, err = readTokenCache(dir)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to read token cache: %v\n", err)
+		os.Exit(1)
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		scope, rest, _ := strings.Cut(key, " ")
+		tenant, _, _ := strings.Cut(rest, " ")
+		expires := time.Unix(entries[key].ExpiresOn, 0)
+		state := ""
+		if time.Now().After(expires) {
+			state = " (expired)"
+		}
+		fmt.Printf("%s tenant=%s expires=%s%s\n", scope, tenant, expires.UTC().Format(time.RFC3339), state)
+	}
+}
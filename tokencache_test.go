@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCache(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	setTestConfig(t, "azureclicredentialhelper.cachedir", dir)
+	const resource = "https://dev.azure.com"
+	future := time.Now().Add(time.Hour).Unix()
+
+	if _, _, ok := lookupCachedToken(resource, ""); ok {
+		t.Fatal("empty cache returned a token")
+	}
+
+	storeCachedToken(resource, "", "token-a", future)
+	storeCachedToken(resource+"/", "tenant-b", "token-b", future)
+	storeCachedToken("https://soon.example.com", "", "token-soon", time.Now().Add(time.Minute).Unix())
+	storeCachedToken("https://never.example.com", "", "token-never", 0)
+
+	tests := []struct {
+		resource string
+		tenant   string
+		want     string
+		wantOK   bool
+	}{
+		{resource, "", "token-a", true},
+		{resource + "/.default", "default", "token-a", true},
+		{resource, "tenant-b", "token-b", true},
+		{resource, "tenant-c", "", false},
+		{"https://soon.example.com", "", "", false},
+		{"https://never.example.com", "", "", false},
+	}
+	for _, tt := range tests {
+		token, expiry, ok := lookupCachedToken(tt.resource, tt.tenant)
+		if token != tt.want || ok != tt.wantOK || (ok && expiry != future) {
+			t.Errorf("lookupCachedToken(%q, %q) = %q, %d, %t, want %q, %t", tt.resource, tt.tenant, token, expiry, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, tokenCacheFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("token-a")) {
+		t.Error("token cache is stored in plaintext")
+	}
+	for _, name := range []string{tokenCacheFileName, tokenCacheKeyName} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0o600 {
+			t.Errorf("%s has mode %v, want 0600", name, fi.Mode().Perm())
+		}
+	}
+
+	eraseCachedToken(resource, "")
+	if _, _, ok := lookupCachedToken(resource, ""); ok {
+		t.Error("erased token is still cached")
+	}
+	if token, _, _ := lookupCachedToken(resource, "tenant-b"); token != "token-b" {
+		t.Errorf("erase dropped another tenant's token, got %q", token)
+	}
+
+	if err := clearTokenCache(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := lookupCachedToken(resource, "tenant-b"); ok {
+		t.Error("token is still cached after clear")
+	}
+}
+
+func TestTokenCacheKeySource(t *testing.T) {
+	setTestConfig(t)
+	cliKey := tokenCacheKey("https://dev.azure.com", "")
+	setTestConfig(t, "azureclicredentialhelper.credentialtype", "managedidentity")
+	if tokenCacheKey("https://dev.azure.com", "") == cliKey {
+		t.Error("changing credentialType didn't change the cache key")
+	}
+}
+
+// withStdin runs fn with input on stdin.
+func withStdin(t *testing.T, input string, fn func()) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.WriteString(input)
+		w.Close()
+	}()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	fn()
+}
+
+func TestStoreAndErase(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	setTestConfig(t, "azureclicredentialhelper.cachedir", dir)
+	const request = "protocol=https\nhost=dev.azure.com\nusername=null\npassword=token-a\npassword_expiry_utc=4070908800\n\n"
+	storeCachedToken("https://dev.azure.com", "", "token-a", time.Now().Add(time.Hour).Unix())
+
+	tests := []struct {
+		name       string
+		run        func()
+		wantCached bool
+	}{
+		{"store", func() { storeCommand(nil, nil) }, true},
+		{"erase", func() { eraseCommand(nil, nil) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureStdout(t, func() { withStdin(t, request, tt.run) })
+			if out != "" {
+				t.Errorf("%s wrote %q to stdout", tt.name, out)
+			}
+			if _, _, ok := lookupCachedToken("https://dev.azure.com", ""); ok != tt.wantCached {
+				t.Errorf("after %s, token cached = %t, want %t", tt.name, ok, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestApproveAndRejectAliases(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	setTestConfig(t, "azureclicredentialhelper.cachedir", dir)
+	const request = "protocol=https\nhost=dev.azure.com\nusername=null\npassword=token-a\n\n"
+	storeCachedToken("https://dev.azure.com", "", "token-a", time.Now().Add(time.Hour).Unix())
+
+	tests := []struct {
+		alias      string
+		want       string
+		wantCached bool
+	}{
+		{"approve", "store", true},
+		{"reject", "erase", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alias, func(t *testing.T) {
+			rootCmd := newRootCommand()
+			if cmd, _, err := rootCmd.Find([]string{tt.alias}); err != nil || cmd.Name() != tt.want {
+				t.Fatalf("%s resolved to %v, %v, want %s", tt.alias, cmd, err, tt.want)
+			}
+			rootCmd.SetArgs([]string{tt.alias})
+			withStdin(t, request, func() { rootCmd.Execute() })
+			if _, _, ok := lookupCachedToken("https://dev.azure.com", ""); ok != tt.wantCached {
+				t.Errorf("after %s, token cached = %t, want %t", tt.alias, ok, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestRealmTokenCachedUnderRealm(t *testing.T) {
+	setTestConfig(t, "azureclicredentialhelper.cachedir", filepath.Join(t.TempDir(), "cache"))
+	notFound := errors.New("AADSTS500011: The resource principal was not found")
+	cred := &stubCredential{errs: []error{notFound}}
+	setTestCredential(t, "", cred)
+	const realm = "https://realm.example.com"
+	resource := getResourceForHost("https", "git.example.com")
+	wwwauth := []string{`Bearer realm="` + realm + `"`}
+
+	token, _, err := acquireToken(context.Background(), "https", "git.example.com", wwwauth, nil)
+	if err != nil || token != "token" {
+		t.Fatalf("acquireToken = %q, %v, want the realm token", token, err)
+	}
+	if _, _, ok := lookupCachedToken(realm, ""); !ok {
+		t.Error("realm token wasn't cached under the realm")
+	}
+	if _, _, ok := lookupCachedToken(resource, ""); ok {
+		t.Errorf("realm token was cached under the primary resource %s", resource)
+	}
+
+	// The next request finds the realm token without asking for it again
+	cred = &stubCredential{errs: []error{notFound, notFound}}
+	setTestCredential(t, "", cred)
+	if token, _, err := acquireToken(context.Background(), "https", "git.example.com", wwwauth, nil); err != nil || token != "token" {
+		t.Fatalf("second acquireToken = %q, %v, want the cached realm token", token, err)
+	}
+	if cred.calls != 1 {
+		t.Errorf("GetToken called %d times, want 1 (the primary resource only)", cred.calls)
+	}
+}
+
+func TestCacheClearHost(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	setTestConfig(t,
+		"azureclicredentialhelper.cachedir", dir,
+		"azureclicredentialhelper.https://tenant.example.com.tenant", "tenant-t",
+	)
+	future := time.Now().Add(time.Hour).Unix()
+	devops := getResourceForHost("https", "dev.azure.com")
+	other := getResourceForHost("https", "tenant.example.com")
+	storeCachedToken(devops, "", "token-a", future)
+	storeCachedToken(other, "tenant-t", "token-t", future)
+	storeCachedToken(other, "", "token-u", future)
+
+	out := captureStdout(t, func() { cacheClearCommand(nil, []string{"https://tenant.example.com/org/_git/repo"}) })
+	if !strings.Contains(out, "Cleared 1 cached token") {
+		t.Errorf("cache clear printed %q", out)
+	}
+	if _, _, ok := lookupCachedToken(other, "tenant-t"); ok {
+		t.Error("host's token is still cached")
+	}
+	for _, tt := range []struct{ resource, tenant string }{{devops, ""}, {other, ""}} {
+		if _, _, ok := lookupCachedToken(tt.resource, tt.tenant); !ok {
+			t.Errorf("clearing one host dropped the token for %s (tenant %q)", tt.resource, tt.tenant)
+		}
+	}
+
+	captureStdout(t, func() { cacheClearCommand(nil, []string{"dev.azure.com"}) })
+	if _, _, ok := lookupCachedToken(devops, ""); ok {
+		t.Error("bare host form didn't clear the token")
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	home := t.TempDir()
+	tests := []struct {
+		name   string
+		env    string
+		config string
+		want   string
+	}{
+		{"default", "", "", filepath.Join(home, ".cache", "git-credential-azure-cli")},
+		{"config", "", filepath.Join(home, "configured"), filepath.Join(home, "configured")},
+		{"config with ~", "", "~/tilde", filepath.Join(home, "tilde")},
+		{"env beats config", filepath.Join(home, "env"), filepath.Join(home, "configured"), filepath.Join(home, "env")},
+		{"env with ~", "~/env-tilde", "", filepath.Join(home, "env-tilde")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.config == "" {
+				setTestConfig(t)
+			} else {
+				setTestConfig(t, "azureclicredentialhelper.cachedir", tt.config)
+			}
+			t.Setenv("HOME", home)
+			t.Setenv("XDG_CACHE_HOME", "")
+			t.Setenv("AZURE_CLI_HELPER_CACHE_DIR", tt.env)
+			dir, err := cacheDir()
+			if err != nil || dir != tt.want {
+				t.Fatalf("cacheDir() = %q, %v, want %q", dir, err, tt.want)
+			}
+			if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+				t.Errorf("cacheDir() didn't create %s", dir)
+			}
+		})
+	}
+	t.Setenv("AZURE_CLI_HELPER_CACHE_DIR", filepath.Join(home, "env"))
+	if got := policyCachePath("https://policy.example.com"); filepath.Dir(got) != filepath.Join(home, "env") {
+		t.Errorf("policyCachePath = %q, want it under the cache directory", got)
+	}
+}
+
+func TestCachedTokenFallback(t *testing.T) {
+	const resource = "https://dev.azure.com"
+	tests := []struct {
+		name      string
+		err       error
+		expiresIn time.Duration
+		wantToken string
+	}{
+		{"throttled", throttledError("60"), 2 * time.Minute, "token-soon"},
+		{"transient", errors.New("connection reset by peer"), 2 * time.Minute, "token-soon"},
+		{"auth failure", errors.New("AADSTS700082: The refresh token has expired due to inactivity."), 2 * time.Minute, ""},
+		{"about to expire", throttledError("60"), 30 * time.Second, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, "azureclicredentialhelper.cachedir", filepath.Join(t.TempDir(), "cache"))
+			storeCachedToken(resource, "", "token-soon", time.Now().Add(tt.expiresIn).Unix())
+			errs := make([]error, maxAttempts)
+			for i := range errs {
+				errs[i] = tt.err
+			}
+			setTestCredential(t, "", &stubCredential{errs: errs})
+			// Too short to wait out a retry, so the first failure is final
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			token, _, err := acquireToken(ctx, "https", "dev.azure.com", nil, nil)
+			if token != tt.wantToken || (err == nil) != (tt.wantToken != "") {
+				t.Errorf("acquireToken = %q, %v, want %q", token, err, tt.wantToken)
+			}
+		})
+	}
+}